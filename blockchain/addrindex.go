@@ -0,0 +1,295 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	addrIndexPrefix = []byte("addr-")     // 地址索引的键前缀
+	addrIndexKey    = []byte("addrindex") // 存在该键时表示已启用地址索引
+
+	ErrAddrIndexDisabled = errors.New("address index is not enabled")
+)
+
+// AddressTx 表示一笔与地址相关的交易
+type AddressTx struct {
+	TxID     []byte // 交易 ID
+	Height   int    // 交易所在区块的高度
+	Received int    // 交易输出中支付给该地址的金额
+	Sent     int    // 交易输入中花费的该地址的金额
+}
+
+// Direction 返回交易相对于地址的方向，收到的金额大于花费的金额时为 "in"，否则为 "out"
+func (atx AddressTx) Direction() string {
+	if atx.Received >= atx.Sent {
+		return "in"
+	}
+	return "out"
+}
+
+// Amount 返回交易使地址余额变化的绝对值
+func (atx AddressTx) Amount() int {
+	if atx.Received >= atx.Sent {
+		return atx.Received - atx.Sent
+	}
+	return atx.Sent - atx.Received
+}
+
+// addrKey 返回保存地址交易记录的键：前缀 + 公钥哈希 + 大端序高度 + 交易 ID
+// 同一地址的记录按高度排序，便于按时间顺序分页读取
+func addrKey(pubKeyHash []byte, height int, txID []byte) []byte {
+	key := append(append([]byte{}, addrIndexPrefix...), pubKeyHash...)
+	key = binary.BigEndian.AppendUint64(key, uint64(height))
+	return append(key, txID...)
+}
+
+// blockAddressTxs 统计区块中每笔交易对各个地址的收支
+func blockAddressTxs(txn Txn, block *Block) ([]AddressTx, [][]byte, error) {
+	spent, err := blockSpentOutputs(txn, block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []AddressTx
+	var owners [][]byte
+	for _, tx := range block.Transactions {
+		byAddress := make(map[string]*AddressTx)
+		var order []string
+		record := func(pubKeyHash []byte) *AddressTx {
+			key := hex.EncodeToString(pubKeyHash)
+			if _, ok := byAddress[key]; !ok {
+				byAddress[key] = &AddressTx{TxID: tx.ID, Height: block.Height}
+				order = append(order, key)
+			}
+			return byAddress[key]
+		}
+
+		if !tx.IsCoinbase() {
+			for range tx.Inputs {
+				if len(spent) == 0 {
+					return nil, nil, fmt.Errorf("undo data of block %x is incomplete", block.Hash)
+				}
+				out := spent[0].Output
+				spent = spent[1:]
+				record(out.PubKeyHash).Sent += out.Value
+			}
+		}
+		for _, out := range tx.Outputs {
+			record(out.PubKeyHash).Received += out.Value
+		}
+
+		for _, key := range order {
+			pubKeyHash, _ := hex.DecodeString(key)
+			records = append(records, *byAddress[key])
+			owners = append(owners, pubKeyHash)
+		}
+	}
+
+	return records, owners, nil
+}
+
+// blockSpentOutputs 按花费顺序返回区块中所有交易输入引用的输出
+// 优先使用撤销数据，没有撤销数据的旧区块从其所在分支上查找前置交易
+func blockSpentOutputs(txn Txn, block *Block) ([]SpentOutput, error) {
+	v, err := txn.Get(undoKey(block.Hash))
+	if err == nil {
+		undo, err := DeserializeUndo(v)
+		return undo.Spent, err
+	}
+	if err != ErrKeyNotFound {
+		return nil, err
+	}
+
+	var spent []SpentOutput
+	for t, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			prevTX, err := findTransactionTxn(txn, block, t, in.ID)
+			if err != nil {
+				return nil, err
+			}
+			if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+				return nil, ruleError(block, ErrMissingInput, "%x:%d", in.ID, in.Out)
+			}
+			spent = append(spent, SpentOutput{TxID: in.ID, Index: in.Out, Output: prevTX.Outputs[in.Out]})
+		}
+	}
+
+	return spent, nil
+}
+
+// findTransactionTxn 在事务中查找区块第 pos 笔交易之前或区块所在分支上的交易
+func findTransactionTxn(txn Txn, block *Block, pos int, ID []byte) (*Transaction, error) {
+	for _, tx := range block.Transactions[:pos] {
+		if bytes.Equal(tx.ID, ID) {
+			return tx, nil
+		}
+	}
+
+	for hash := block.PrevHash; len(hash) > 0; {
+		b, err := getBlock(txn, hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range b.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return tx, nil
+			}
+		}
+		hash = b.PrevHash
+	}
+
+	return nil, ruleError(block, ErrMissingInput, "%x", ID)
+}
+
+// connectAddrIndex 在启用地址索引时记录区块中与各个地址相关的交易
+func (chain *BlockChain) connectAddrIndex(txn Txn, block *Block) error {
+	enabled, err := indexEnabled(txn, addrIndexKey)
+	if err != nil || !enabled {
+		return err
+	}
+
+	records, owners, err := blockAddressTxs(txn, block)
+	if err != nil {
+		return err
+	}
+	for i, atx := range records {
+		if err := txn.Put(addrKey(owners[i], atx.Height, atx.TxID), atx.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disconnectAddrIndex 在启用地址索引时删除区块中与各个地址相关的交易
+func (chain *BlockChain) disconnectAddrIndex(txn Txn, block *Block) error {
+	enabled, err := indexEnabled(txn, addrIndexKey)
+	if err != nil || !enabled {
+		return err
+	}
+
+	records, owners, err := blockAddressTxs(txn, block)
+	if err != nil {
+		return err
+	}
+	for i, atx := range records {
+		if err := txn.Delete(addrKey(owners[i], atx.Height, atx.TxID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddrIndexEnabled 检查是否已启用地址索引
+func (chain *BlockChain) AddrIndexEnabled() (bool, error) {
+	var enabled bool
+
+	err := chain.Database.View(func(txn Txn) error {
+		var err error
+		enabled, err = indexEnabled(txn, addrIndexKey)
+		return err
+	})
+
+	return enabled, err
+}
+
+// ReindexAddresses 遍历主链重建地址索引并启用该索引，返回索引的记录数量
+func (chain *BlockChain) ReindexAddresses() (int, error) {
+	UTXOSet := UTXOSet{chain}
+	if err := UTXOSet.DeleteByPrefix(addrIndexPrefix); err != nil {
+		return 0, err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for height := 0; height <= bestHeight; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return 0, err
+		}
+
+		err = chain.Database.Update(func(txn Txn) error {
+			records, owners, err := blockAddressTxs(txn, &block)
+			if err != nil {
+				return err
+			}
+			for i, atx := range records {
+				if err := txn.Put(addrKey(owners[i], atx.Height, atx.TxID), atx.Serialize()); err != nil {
+					return err
+				}
+			}
+			count += len(records)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = chain.Database.Update(func(txn Txn) error {
+		return txn.Put(addrIndexKey, []byte{1})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// AddressHistory 返回与公钥哈希相关的交易，按区块高度从新到旧排列
+// 跳过前 offset 条记录后最多返回 limit 条，同时返回记录总数
+func (chain *BlockChain) AddressHistory(pubKeyHash []byte, offset, limit int) ([]AddressTx, int, error) {
+	var history []AddressTx
+	total := 0
+
+	err := chain.Database.View(func(txn Txn) error {
+		enabled, err := indexEnabled(txn, addrIndexKey)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrAddrIndexDisabled
+		}
+
+		// 键中的高度使用大端序编码，反向遍历即按高度从新到旧排列
+		prefix := append(append([]byte{}, addrIndexPrefix...), pubKeyHash...)
+		return txn.Iterate(prefix, true, func(key, value []byte) error {
+			if total >= offset && len(history) < limit {
+				atx, err := DeserializeAddressTx(value)
+				if err != nil {
+					return err
+				}
+				history = append(history, atx)
+			}
+			total++
+			return nil
+		})
+	})
+
+	return history, total, err
+}
+
+// Serialize 将地址交易记录按规范编码格式序列化为字节数组
+func (atx AddressTx) Serialize() []byte {
+	var e encoder
+	atx.encode(&e)
+
+	return e.Bytes()
+}
+
+// DeserializeAddressTx 将规范编码的字节数组反序列化为地址交易记录
+func DeserializeAddressTx(data []byte) (AddressTx, error) {
+	return decodeAddressTx(data)
+}
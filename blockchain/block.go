@@ -1,91 +1,81 @@
 package blockchain
 
 import (
-	"bytes"
-	"encoding/gob"
-	"log"
+	"context"
 	"time"
 )
 
-// Block 结构体表示区块链中的一个区块
+// Block 结构体表示区块链中的一个区块，由区块头和交易列表组成
 type Block struct {
-	Timestamp    int64          // 区块创建时间戳
+	BlockHeader
 	Hash         []byte         // 当前区块的哈希值
 	Transactions []*Transaction // 区块中包含的交易列表
-	PrevHash     []byte         // 上一个区块的哈希值
-	Nonce        int            // 用于工作量证明（PoW）的随机数
-	Height       int            // 区块高度（区块在区块链中的位置）
 }
 
 // HashTransactions 方法计算并返回区块中所有交易的 Merkle 树的根哈希
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
-
-	// 对区块中的每一笔交易进行序列化，并计算哈希
-	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
-	}
-
 	// 使用 Merkle 树计算所有交易的哈希
-	tree := NewMerkleTree(txHashes)
+	tree := b.MerkleTree()
 
 	// 返回 Merkle 树根节点的哈希值
 	return tree.RootNode.Data
 }
 
-// CreateBlock 创建一个新的区块，并计算该区块的哈希值
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	// 创建一个新的区块，区块的时间戳、上一个区块哈希值、交易列表、区块高度等信息
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
+// MerkleTree 使用区块中的所有交易构建 Merkle 树，叶子和哈希方式由区块头版本决定
+func (b *Block) MerkleTree() *MerkleTree {
+	var leaves [][]byte
+
+	// 取出每一笔交易作为叶子的数据
+	for _, tx := range b.Transactions {
+		leaves = append(leaves, tx.merkleData(b.Version))
+	}
+
+	return newMerkleTree(merkleHasherFor(b.Version), leaves)
+}
+
+// CreateBlock 创建一个新的区块，并按照给定的难度目标计算该区块的哈希值
+// ctx 被取消时停止挖矿并返回错误
+func CreateBlock(ctx context.Context, txs []*Transaction, prevHash []byte, height int, bits uint32) (*Block, error) {
+	// 创建一个新的区块，区块头包含上一个区块哈希值、时间戳、区块高度、难度目标等信息
+	header := BlockHeader{HeaderVersion, prevHash, nil, time.Now().Unix(), bits, 0, height}
+	block := &Block{header, []byte{}, txs}
+	block.MerkleRoot = block.HashTransactions()
 
 	// 创建一个工作量证明对象并运行 PoW 算法来获取 nonce 和区块的哈希
 	pow := NewProof(block)
-	nonce, hash := pow.Run()
+	nonce, hash, err := pow.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// 设置区块的哈希和 nonce
 	block.Hash = hash[:]
 	block.Nonce = nonce
 
 	// 返回创建的区块
-	return block
-}
-
-// Genesis 创建创世区块（区块链的第一个区块）
-func Genesis(coinbase *Transaction) *Block {
-	// 创建创世区块，coinbase 是包含挖矿奖励的交易
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return block, nil
 }
 
-// Serialize 将区块序列化为字节数组，便于存储或网络传输
+// Serialize 将区块按规范编码格式序列化为字节数组，便于存储或网络传输
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+	var e encoder
+	b.encode(&e)
 
-	// 编码区块对象
-	err := encoder.Encode(b)
-
-	Handle(err)
-
-	return res.Bytes()
+	return e.Bytes()
 }
 
-// Deserialize 将字节数组反序列化为区块对象
-func Deserialize(data []byte) *Block {
-	var block Block
+// serializeBody 将区块体（交易列表）按规范编码格式序列化为字节数组
+func (b *Block) serializeBody() []byte {
+	var e encoder
+	b.encodeBody(&e)
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
+	return e.Bytes()
+}
 
+// Deserialize 将规范编码的字节数组反序列化为区块对象
+// 数据格式错误时返回包装了 ErrBadEncoding 的错误
+func Deserialize(data []byte) (*Block, error) {
 	// 解码字节数组为区块对象
-	err := decoder.Decode(&block)
-
-	Handle(err)
-
-	return &block
+	return decodeBlock(data)
 }
 
-// Handle 用于处理错误，如果有错误则触发 panic
-func Handle(err error) {
-	if err != nil {
-		log.Panic(err)
-	}
-}
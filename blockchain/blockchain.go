@@ -2,28 +2,44 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"math/big"
 	"os"
 	"path/filepath"
-	"runtime"
-	"strings"
-
-	"github.com/dgraph-io/badger/v3"
+	"sync"
 )
 
-const (
-	dbPath      = "./tmp/blocks_%s"         // 数据库路径模板
-	genesisData = "First Transaction from Genesis" // 创世块的交易数据
+const blocksDir = "blocks" // 区块链数据库在数据目录中的子目录名
+
+// MaxReorgDepth 是一次链重组最多断开的主链区块数
+// 链重组在一个数据库事务中完成，断开和连接的区块过多时事务会超出 badger 的大小限制
+const MaxReorgDepth = 20
+
+var workPrefix = []byte("work-") // 区块累计工作量的键前缀
+
+// 打开或查询区块链时可能返回的错误，通过 errors.Is 判断
+var (
+	ErrNoBlockchain     = errors.New("no existing blockchain found, create one first")
+	ErrBlockchainExists = errors.New("blockchain already exists")
+	ErrBlockNotFound    = errors.New("block is not found")
+	ErrTxNotFound       = errors.New("transaction does not exist")
+	ErrWrongGenesis     = errors.New("blockchain has a different genesis block than the network")
+	ErrReorgTooDeep     = errors.New("reorganization is deeper than MaxReorgDepth")
 )
 
 // BlockChain 结构表示区块链
+// 多个协程可以同时使用同一个区块链，并发读取链头时使用 Tip
 type BlockChain struct {
-	LastHash []byte // 链中最后一个区块的哈希值
-	Database *badger.DB // 存储区块链数据的数据库
+	LastHash []byte       // 链中最后一个区块的哈希值
+	Database Store        // 存储区块链数据的数据库
+	Params   *ChainParams // 区块链所属网络的参数
+
+	addMutex sync.Mutex   // 串行化 AddBlock，同一时间只有一个区块在修改主链
+	tipMutex sync.RWMutex // 保护 LastHash
 }
 
 // DBexists 检查数据库是否存在
@@ -35,155 +51,394 @@ func DBexists(path string) bool {
 	return true
 }
 
-// ContinueBlockChain 连接到已存在的区块链
-func ContinueBlockChain(nodeId string) *BlockChain {
-	// 根据 nodeId 创建数据库路径
-	path := fmt.Sprintf(dbPath, nodeId)
-	// 如果数据库不存在，则打印信息并退出
-	if !DBexists(path) {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit() // 退出程序
+// DBPath 返回数据目录 dataDir 中区块链数据库的路径
+func DBPath(dataDir string) string {
+	return filepath.Join(dataDir, blocksDir)
+}
+
+// ContinueBlockChain 连接到数据目录 dataDir 中的区块链
+// 数据库不存在时使用网络的创世区块自动创建，数据库中的区块链属于其它网络时返回 ErrWrongGenesis
+func ContinueBlockChain(dataDir string, params *ChainParams) (*BlockChain, error) {
+	path := DBPath(dataDir)
+	exists := DBexists(path)
+
+	// 打开数据库
+	store, err := OpenBadgerStore(path)
+	if err != nil {
+		return nil, err
 	}
 
-	var lastHash []byte
+	var chain *BlockChain
+	if exists {
+		chain, err = LoadBlockChain(store, params)
+	} else {
+		chain, err = NewBlockChain(store, params)
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-	// 初始化 Badger 数据库选项
-	opts := badger.DefaultOptions(path).
-		WithLogger(nil).               // 禁用日志
-		WithLoggingLevel(badger.ERROR) // 只显示错误日志
-	opts.Dir = path
-	opts.ValueDir = path
+	return chain, nil
+}
 
-	// 打开数据库
-	db, err := openDB(path, opts)
-	Handle(err)
+// LoadBlockChain 使用已保存区块链的存储创建区块链实例，必要时升级旧版本的数据格式
+// 存储中没有区块链时返回 ErrNoBlockchain，区块链的创世区块与网络参数不一致时返回 ErrWrongGenesis
+func LoadBlockChain(store Store, params *ChainParams) (*BlockChain, error) {
+	var lastHash []byte
 
 	// 从数据库中获取最后一个区块的哈希
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = make([]byte, len(val))
-			copy(lastHash, val)
-			return nil
-		})
+	err := store.View(func(txn Txn) error {
+		var err error
+		lastHash, err = txn.Get([]byte("lh"))
 		return err
 	})
-	Handle(err)
+	if err == ErrKeyNotFound {
+		return nil, ErrNoBlockchain
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading chain tip: %w", err)
+	}
 
 	// 返回区块链实例
-	blockchain := BlockChain{lastHash, db}
-	return &blockchain
+	blockchain := BlockChain{LastHash: lastHash, Database: store, Params: params}
+
+	// 升级旧版本创建的数据库
+	if err := blockchain.migrate(); err != nil {
+		return nil, err
+	}
+
+	if err := blockchain.ensureHeightIndex(); err != nil {
+		return nil, err
+	}
+
+	// 其它网络或旧版本随意创建的区块链不能与网络中的节点同步
+	genesisHash, err := blockchain.GetBlockHashByHeight(0)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(genesisHash, params.Genesis.Hash) {
+		return nil, fmt.Errorf("%w: %x, %s genesis is %x", ErrWrongGenesis, genesisHash, params.Name, params.Genesis.Hash)
+	}
+
+	return &blockchain, nil
 }
 
-// InitBlockChain 初始化一个新的区块链
-func InitBlockChain(address, nodeId string) *BlockChain {
-	// 根据 nodeId 创建数据库路径
-	path := fmt.Sprintf(dbPath, nodeId)
-	var lastHash []byte
+// InitBlockChain 在数据目录 dataDir 中使用网络的创世区块初始化一个新的区块链
+// 数据库已经存在时返回 ErrBlockchainExists
+func InitBlockChain(dataDir string, params *ChainParams) (*BlockChain, error) {
+	path := DBPath(dataDir)
 
-	// 如果数据库已经存在，则退出
+	// 如果数据库已经存在，则返回错误
 	if DBexists(path) {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+		return nil, ErrBlockchainExists
 	}
 
-	// 初始化 Badger 数据库选项
-	opts := badger.DefaultOptions(path).
-		WithLogger(nil).               // 禁用日志
-		WithLoggingLevel(badger.ERROR) // 只显示错误日志
-	opts.Dir = path
-	opts.ValueDir = path
-
 	// 打开数据库
-	db, err := openDB(path, opts)
-	Handle(err)
+	store, err := OpenBadgerStore(path)
+	if err != nil {
+		return nil, err
+	}
 
-	// 创建创世块并存储到数据库中
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData) // 创世块的 coinbase 交易
-		genesis := Genesis(cbtx)                // 创建创世块
+	chain, err := NewBlockChain(store, params)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// NewBlockChain 在空的存储中使用网络的创世区块创建区块链
+// 存储中已经有区块链时返回 ErrBlockchainExists
+func NewBlockChain(store Store, params *ChainParams) (*BlockChain, error) {
+	genesis, err := params.GenesisBlock()
+	if err != nil {
+		return nil, err
+	}
+	blockchain := BlockChain{LastHash: genesis.Hash, Database: store, Params: params}
+
+	// 将创世块及其UTXO存储到数据库中
+	err = store.Update(func(txn Txn) error {
+		if _, err := txn.Get([]byte("lh")); err != ErrKeyNotFound {
+			if err == nil {
+				return ErrBlockchainExists
+			}
+			return err
+		}
 
 		// 将创世块存储到数据库
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		Handle(err)
+		if err := putBlock(txn, genesis); err != nil {
+			return err
+		}
+
+		// 存储创世块的累计工作量
+		if err := txn.Put(workKey(genesis.Hash), genesis.Work().Bytes()); err != nil {
+			return err
+		}
+
+		// 存储创世块的高度索引
+		if err := txn.Put(heightKey(0), genesis.Hash); err != nil {
+			return err
+		}
+
+		// 创世区块的输出加入UTXO集合
+		UTXOSet := UTXOSet{&blockchain}
+		if err := UTXOSet.connect(txn, genesis); err != nil {
+			return err
+		}
+
+		// 记录数据库格式版本
+		if err := setDBVersion(txn, dbVersion); err != nil {
+			return err
+		}
 
 		// 存储最后一个区块的哈希
-		err = txn.Set([]byte("lh"), genesis.Hash)
-		lastHash = genesis.Hash
-		return err
+		return txn.Put([]byte("lh"), genesis.Hash)
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
-	// 返回区块链实例
-	blockchain := BlockChain{lastHash, db}
-	return &blockchain
+	return &blockchain, nil
 }
 
 // AddBlock 添加新块到区块链
-func (chain *BlockChain) AddBlock(block *Block) {
-	var lastHash []byte
-	var lastBlockData []byte
+// 区块通过共识验证后才会保存，并按照累计工作量选择主链：只有当新块所在分支的
+// 累计工作量严格大于当前主链时才会切换链头，必要时执行链重组
+// 区块违反共识规则时返回 *RuleError，数据库不会发生任何修改
+// 需要断开没有撤销数据的旧区块才能完成的链重组无法验证新分支，返回 ErrMissingUndoData
+// 需要断开超过 MaxReorgDepth 个区块的链重组返回 ErrReorgTooDeep，新区块不会被保存
+func (chain *BlockChain) AddBlock(block *Block) error {
+	var newTip bool
+
+	chain.addMutex.Lock()
+	defer chain.addMutex.Unlock()
+
+	// 已存在的区块直接忽略
+	if chain.HasBlock(block.Hash) {
+		return nil
+	}
 
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		// 如果块已存在，则返回
-		if _, err := txn.Get(block.Hash); err == nil {
-			return nil
+	if err := chain.ValidateBlock(block); err != nil {
+		return err
+	}
+
+	err := chain.Database.Update(func(txn Txn) error {
+		// 将区块头和区块体存储到数据库中
+		if err := putBlock(txn, block); err != nil {
+			return err
 		}
 
-		// 将块数据存储到数据库中
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		Handle(err)
+		parentWork, err := chainWork(txn, block.PrevHash)
+		if err != nil {
+			return err
+		}
 
-		// 获取链的最后一个区块的哈希
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = make([]byte, len(val))
-			copy(lastHash, val)
-			return nil
-		})
-		Handle(err)
-
-		// 获取最后一个区块数据
-		item, err = txn.Get(lastHash)
-		Handle(err)
-		err = item.Value(func(val []byte) error {
-			lastBlock := Deserialize(val)
-			lastBlockData = lastBlock.Serialize()
+		work := new(big.Int).Add(parentWork, block.Work())
+		if err := txn.Put(workKey(block.Hash), work.Bytes()); err != nil {
+			return err
+		}
+
+		// 获取当前链头及其累计工作量
+		lastHash, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		tipWork, err := chainWork(txn, lastHash)
+		if err != nil {
+			return err
+		}
+
+		// 工作量相同时保留先收到的链头
+		if work.Cmp(tipWork) <= 0 {
 			return nil
-		})
-		Handle(err)
+		}
+
+		detach, attach, err := findFork(txn, lastHash, block)
+		if err != nil {
+			return err
+		}
 
-		lastBlock := Deserialize(lastBlockData)
+		if len(detach) > MaxReorgDepth {
+			return fmt.Errorf("%w: disconnect %d blocks to reach %x", ErrReorgTooDeep, len(detach), block.Hash)
+		}
 
-		// 如果新块高度高于最后一个块，则更新最后哈希
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			Handle(err)
-			chain.LastHash = block.Hash
+		if len(detach) > 0 {
+			fmt.Printf("Reorganize: disconnect %d blocks, connect %d blocks\n", len(detach), len(attach))
 		}
 
+		// 断开旧分支上的区块，再依次连接新分支上的区块
+		// 任意区块连接失败时整个事务被丢弃，链头保持不变
+		// 新分支的每个区块都必须在断开后的UTXO集合上通过双花和成熟度检查，
+		// 旧区块没有撤销数据时无法恢复断开后的UTXO集合，因此拒绝这次链重组
+		UTXOSet := UTXOSet{chain}
+		for _, b := range detach {
+			if err := chain.disconnectIndexes(txn, b); err != nil {
+				return err
+			}
+			if err := UTXOSet.disconnect(txn, b); err != nil {
+				if errors.Is(err, ErrMissingUndoData) {
+					return fmt.Errorf("cannot disconnect block %x: %w", b.Hash, err)
+				}
+				return err
+			}
+		}
+		for _, b := range attach {
+			if err := UTXOSet.connect(txn, b); err != nil {
+				return err
+			}
+			if err := chain.connectIndexes(txn, b); err != nil {
+				return err
+			}
+		}
+
+		if err := txn.Put([]byte("lh"), block.Hash); err != nil {
+			return err
+		}
+		newTip = true
+
 		return nil
 	})
-	Handle(err)
+	if err != nil {
+		return err
+	}
+
+	// 事务提交成功后才更新内存中的链头
+	if newTip {
+		chain.tipMutex.Lock()
+		chain.LastHash = block.Hash
+		chain.tipMutex.Unlock()
+	}
+
+	return nil
+}
+
+// findFork 查找旧链头与新区块之间的分叉点
+// 返回需要从主链断开的区块（从旧链头向下）和需要连接的区块（从分叉点向上）
+func findFork(txn Txn, oldTip []byte, newBlock *Block) ([]*Block, []*Block, error) {
+	var detach, attach []*Block
+
+	oldBlock, err := getBlock(txn, oldTip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 先将两个分支回溯到相同高度，再同时回溯直到遇到共同祖先
+	for oldBlock.Height > newBlock.Height {
+		detach = append(detach, oldBlock)
+		if oldBlock, err = getBlock(txn, oldBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for newBlock.Height > oldBlock.Height {
+		attach = append(attach, newBlock)
+		if newBlock, err = getBlock(txn, newBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		detach = append(detach, oldBlock)
+		attach = append(attach, newBlock)
+		if oldBlock, err = getBlock(txn, oldBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+		if newBlock, err = getBlock(txn, newBlock.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 新分支需要按照高度从低到高连接
+	for i, j := 0, len(attach)-1; i < j; i, j = i+1, j-1 {
+		attach[i], attach[j] = attach[j], attach[i]
+	}
+
+	return detach, attach, nil
+}
+
+// chainWork 计算从创世区块到指定区块的累计工作量
+// 已保存的累计工作量直接读取，缺失时（例如旧版本创建的数据库）沿父区块回溯计算
+func chainWork(txn Txn, hash []byte) (*big.Int, error) {
+	var pending []*BlockHeader
+	work := big.NewInt(0)
+
+	for len(hash) > 0 {
+		val, err := txn.Get(workKey(hash))
+		if err == nil {
+			work.SetBytes(val)
+			break
+		}
+		if err != ErrKeyNotFound {
+			return nil, err
+		}
+
+		header, err := getHeader(txn, hash)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, header)
+		hash = header.PrevHash
+	}
+
+	for _, header := range pending {
+		work.Add(work, header.Work())
+	}
+
+	return work, nil
+}
+
+// workKey 返回保存区块累计工作量的键
+func workKey(hash []byte) []byte {
+	return append(append([]byte{}, workPrefix...), hash...)
+}
+
+// getBlock 在事务中读取指定哈希的区块头和区块体并组合为区块
+func getBlock(txn Txn, hash []byte) (*Block, error) {
+	header, err := getHeader(txn, hash)
+	if err != nil {
+		return nil, err
+	}
+	val, err := txn.Get(blockKey(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	block := &Block{BlockHeader: *header, Hash: append([]byte{}, hash...)}
+	d := &decoder{data: val}
+	block.decodeBody(d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// HasBlock 检查数据库中是否已保存指定哈希的区块
+func (chain *BlockChain) HasBlock(blockHash []byte) bool {
+	err := chain.Database.View(func(txn Txn) error {
+		_, err := txn.Get(blockKey(blockHash))
+		return err
+	})
+	return err == nil
 }
 
 // GetBlock 获取指定哈希的区块
 func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(blockHash)
+	err := chain.Database.View(func(txn Txn) error {
+		b, err := getBlock(txn, blockHash)
+		if err == ErrKeyNotFound {
+			return ErrBlockNotFound
+		}
 		if err != nil {
-			return errors.New("Block is not found")
+			return err
 		}
 
-		return item.Value(func(val []byte) error {
-			block = *Deserialize(val)
-			return nil
-		})
+		block = *b
+		return nil
 	})
 	if err != nil {
 		return block, err
@@ -192,125 +447,111 @@ func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// GetBlockHashes 获取区块链中所有区块的哈希值
-func (chain *BlockChain) GetBlockHashes() [][]byte {
+// GetBlockHashes 获取主链中所有区块的哈希值，按照从链头到创世块的顺序排列
+func (chain *BlockChain) GetBlockHashes() ([][]byte, error) {
 	var blocks [][]byte
 
-	iter := chain.Iterator()
-
-	for {
-		block := iter.Next()
-
-		blocks = append(blocks, block.Hash)
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
 
-		if len(block.PrevHash) == 0 {
-			break
+	for height := bestHeight; height >= 0; height-- {
+		hash, err := chain.GetBlockHashByHeight(height)
+		if err != nil {
+			return nil, err
 		}
+
+		blocks = append(blocks, hash)
 	}
 
-	return blocks
+	return blocks, nil
+}
+
+// Tip 返回当前主链链头的哈希，可以与 AddBlock 并发调用
+func (chain *BlockChain) Tip() []byte {
+	chain.tipMutex.RLock()
+	defer chain.tipMutex.RUnlock()
+
+	return chain.LastHash
 }
 
 // GetBestHeight 获取当前区块链的最大高度
-func (chain *BlockChain) GetBestHeight() int {
-	var lastBlock Block
+func (chain *BlockChain) GetBestHeight() (int, error) {
+	var lastHeader *BlockHeader
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
+	err := chain.Database.View(func(txn Txn) error {
 		// 获取最后一个区块的哈希
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			return err
-		}
-		var lastHash []byte
-		err = item.Value(func(val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		})
+		lastHash, err := txn.Get([]byte("lh"))
 		if err != nil {
 			return err
 		}
 
-		// 获取最后一个区块
-		item, err = txn.Get(lastHash)
-		if err != nil {
-			return err
-		}
-		err = item.Value(func(val []byte) error {
-			lastBlock = *Deserialize(val)
-			return nil
-		})
+		// 获取最后一个区块的区块头
+		lastHeader, err = getHeader(txn, lastHash)
 		return err
 	})
 	if err != nil {
-		Handle(err)
+		return 0, err
 	}
 
-	return lastBlock.Height
+	return lastHeader.Height, nil
 }
 
-// MineBlock 挖掘新块并将其添加到区块链
-func (chain *BlockChain) MineBlock(txs []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
-	var lastBlockData []byte
-
-	// 获取最后一个区块的哈希
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-
-		// 使用回调获取值
-		err = item.Value(func(val []byte) error {
-			lastHash = make([]byte, len(val))
-			copy(lastHash, val)
-			return nil
-		})
-		Handle(err)
+// MineBlock 在当前链头上挖掘新块并将其添加到区块链
+// 区块未通过验证或 ctx 被取消时返回错误
+func (chain *BlockChain) MineBlock(ctx context.Context, txs []*Transaction) (*Block, error) {
+	return chain.MineBlockOn(ctx, chain.Tip(), txs)
+}
 
-		err = item.Value(func(val []byte) error {
-			lastBlockData = make([]byte, len(val))
-			copy(lastBlockData, val)
-			return nil
-		})
-		lastBlock := Deserialize(lastBlockData)
-		lastHeight = lastBlock.Height
+// MineBlockOn 以 prevHash 对应的区块为父区块挖掘新块并将其添加到区块链
+// 调用者根据父区块高度计算 coinbase 奖励时使用该方法，避免挖矿前链头发生变化导致奖励与高度不符
+func (chain *BlockChain) MineBlockOn(ctx context.Context, prevHash []byte, txs []*Transaction) (*Block, error) {
+	var lastBlock *Block
 
+	// 获取父区块
+	err := chain.Database.View(func(txn Txn) error {
+		var err error
+		lastBlock, err = getBlock(txn, prevHash)
 		return err
 	})
-	Handle(err)
-
-	// 创建一个新的区块
-	newBlock := CreateBlock(txs, lastHash, lastHeight+1)
-
-	// 更新数据库，将新块及其哈希值存储
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		// 存储新块
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
-
-		// 更新最后一个区块的哈希指针
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-		Handle(err)
+	if err == ErrKeyNotFound {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		// 更新内存中的最后一个哈希
-		chain.LastHash = newBlock.Hash
+	// 计算新区块需要满足的难度目标
+	bits, err := chain.NextBits(lastBlock)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
-	Handle(err)
+	// 创建一个新的区块，并按照主链选择规则添加到区块链
+	newBlock, err := CreateBlock(ctx, txs, lastBlock.Hash, lastBlock.Height+1, bits)
+	if err != nil {
+		return nil, err
+	}
+	if err := chain.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
 
-	return newBlock
+	return newBlock, nil
 }
 
 // FindUTXO 查找所有未花费的交易输出（UTXO）
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
+func (chain *BlockChain) FindUTXO() (map[string]TxOutputs, error) {
 	UTXO := make(map[string]TxOutputs)
 	spentTXOs := make(map[string][]int)
 
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
@@ -326,7 +567,10 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 					}
 				}
 				outs := UTXO[txID]
+				outs.Height = block.Height
+				outs.Coinbase = tx.IsCoinbase()
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
 				UTXO[txID] = outs
 			}
 
@@ -343,15 +587,35 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 			break
 		}
 	}
-	return UTXO
+	return UTXO, nil
 }
 
 // FindTransaction 查找指定 ID 的交易
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := bc.Iterator()
+	return bc.findTransactionFrom(bc.Tip(), ID)
+}
+
+// findTransactionFrom 从指定区块开始沿父区块回溯查找交易
+// 启用交易索引且起始区块位于主链上时直接通过索引查找
+func (bc *BlockChain) findTransactionFrom(blockHash, ID []byte) (Transaction, error) {
+	tx, usable, err := bc.findIndexedTransaction(blockHash, ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if usable {
+		if tx == nil {
+			return Transaction{}, ErrTxNotFound
+		}
+		return *tx, nil
+	}
+
+	iter := &BlockChainIterator{blockHash, bc.Database}
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return Transaction{}, err
+		}
 
 		for _, tx := range block.Transactions {
 			// 如果找到匹配的交易，则返回
@@ -366,69 +630,79 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction does not exist")
+	return Transaction{}, ErrTxNotFound
 }
 
 // SignTransaction 对交易进行签名
-func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		// 查找并获取输入的交易
 		prevTX, err := bc.FindTransaction(in.ID)
-		Handle(err)
+		if err != nil {
+			return fmt.Errorf("%w: %x: %v", ErrMissingInput, in.ID, err)
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return tx.Sign(privKey, prevTXs)
 }
 
-// VerifyTransaction 验证交易的签名
-func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+// VerifyTransaction 验证交易的签名，并检查交易能否被下一个区块打包
+// 交易无效时返回 ErrMissingInput、ErrDoubleSpend、ErrImmatureSpend 或 ErrBadSignature：
+// 输入引用的输出不在UTXO集合中（不存在或已被花费）时返回 ErrMissingInput，
+// 多个输入引用同一个输出时返回 ErrDoubleSpend，花费尚未成熟的 coinbase 输出的交易无效
+func (bc *BlockChain) VerifyTransaction(tx *Transaction) error {
 	prevTXs := make(map[string]Transaction)
+	UTXOSet := UTXOSet{bc}
+	bestHeight, err := bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	spendHeight := bestHeight + 1
 
-	// 获取交易输入的历史交易数据
+	// 同一个输出只能被交易花费一次，否则手续费会被重复计算
+	spent := make(map[string]bool)
 	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		Handle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+		if spent[outpoint] {
+			return fmt.Errorf("%w: %s", ErrDoubleSpend, outpoint)
+		}
+		spent[outpoint] = true
 	}
 
-	return tx.Verify(prevTXs)
-}
-
+	// 获取交易输入的历史交易数据
+	for _, in := range tx.Inputs {
+		// 输入引用的输出必须尚未被花费
+		_, ok, err := UTXOSet.FindOutput(in.ID, in.Out)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
+		}
 
-// retry 函数尝试重新打开数据库，解决 "LOCK" 锁文件导致的数据库无法打开的问题。
-// 它会删除数据库目录中的 "LOCK" 文件，并重试打开数据库。
-func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-	lockPath := filepath.Join(dir, "LOCK") // 构造 "LOCK" 文件的路径
+		outs, _, err := UTXOSet.findOutputs(in.ID)
+		if err != nil {
+			return err
+		}
+		if !outs.IsMature(spendHeight, bc.Params.CoinbaseMaturity) {
+			return fmt.Errorf("%w: %x:%d", ErrImmatureSpend, in.ID, in.Out)
+		}
 
-	// 尝试删除 "LOCK" 文件，可能因为数据库意外关闭留下了该文件
-	if err := os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`removing "LOCK": %s`, err) // 如果删除 "LOCK" 文件失败，返回错误
+		prevTX, err := bc.FindTransaction(in.ID)
+		if errors.Is(err, ErrTxNotFound) {
+			return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
+		}
+		if err != nil {
+			return err
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	retryOpts := originalOpts // 复制原始的数据库选项
-	db, err := badger.Open(retryOpts) // 尝试重新打开数据库
-	return db, err
-}
-
-// openDB 函数用于打开 Badger 数据库。
-// 如果数据库因为 "LOCK" 锁文件而无法打开，它会尝试删除锁文件并重试打开数据库。
-func openDB(dir string, opts badger.Options) (*badger.DB, error) {
-	// 尝试打开数据库
-	if db, err := badger.Open(opts); err != nil {
-		// 如果错误信息包含 "LOCK"，说明数据库被锁定
-		if strings.Contains(err.Error(), "LOCK") {
-			// 尝试删除锁文件并重新打开数据库
-			if db, err := retry(dir, opts); err == nil {
-				log.Println("database unlocked, value log truncated") // 输出数据库已解锁的信息
-				return db, nil // 成功解锁数据库并打开
-			}
-			log.Println("could not unlock database:", err) // 如果无法解锁，输出错误信息
-		}
-		return nil, err // 如果其他错误，直接返回错误
-	} else {
-		return db, nil // 成功打开数据库，返回数据库实例
+	if !tx.Verify(prevTXs) {
+		return fmt.Errorf("%w: %x", ErrBadSignature, tx.ID)
 	}
+	return nil
 }
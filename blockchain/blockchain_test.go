@@ -0,0 +1,23 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyTransactionDuplicateInput(t *testing.T) {
+	params := RegTestParams
+	chain, err := NewBlockChain(NewMemoryStore(), &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个输入引用同一个输出
+	in := TxInput{[]byte{1}, 0, nil, []byte{1}}
+	tx := Transaction{nil, []TxInput{in, in}, []TxOutput{{1, []byte{1}}}, TxVersion}
+	tx.ID = tx.Hash()
+
+	if err := chain.VerifyTransaction(&tx); !errors.Is(err, ErrDoubleSpend) {
+		t.Fatalf("VerifyTransaction = %v, want %v", err, ErrDoubleSpend)
+	}
+}
@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"math/big"
+	"sort"
+)
+
+// 出块间隔、调整周期和目标值上限由网络参数 ChainParams 决定
+const (
+	MaxAdjustFactor  = 4  // 单次调整中目标值最多放大或缩小的倍数
+	MedianTimeBlocks = 11 // 计算中位时间使用的区块数量
+	MaxFutureTime    = 2 * 60 * 60
+)
+
+// legacyTarget 是引入难度调整之前固定使用的目标值，Bits 为 0 的旧区块使用该目标值
+var legacyTarget = new(big.Int).Lsh(big.NewInt(1), 256-Difficulty)
+
+// Target 返回区块头中记录的难度目标
+func (h *BlockHeader) Target() *big.Int {
+	if h.Bits == 0 {
+		return new(big.Int).Set(legacyTarget)
+	}
+	return CompactToBig(h.Bits)
+}
+
+// CompactToBig 将紧凑格式的难度目标转换为大整数
+// 紧凑格式的最高字节为指数，低 3 字节为尾数：target = mantissa * 256^(exponent-3)
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	// 第 24 位为符号位，目标值不允许为负数
+	if compact&0x00800000 != 0 {
+		target.Neg(target)
+	}
+
+	return target
+}
+
+// BigToCompact 将大整数转换为紧凑格式的难度目标
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(target.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(tn.Bits()[0])
+	}
+
+	// 尾数的最高位会被解释为符号位，需要右移一个字节
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+// NextBits 计算链在父区块之后的下一个区块必须使用的难度目标
+// 每 Params.RetargetInterval 个区块根据实际出块时间调整一次目标值，其余区块沿用父区块的目标值
+// 网络参数设置了 NoRetargeting 时始终沿用父区块的目标值
+func (chain *BlockChain) NextBits(parent *Block) (uint32, error) {
+	params := chain.Params
+	parentBits := parent.Bits
+	if parentBits == 0 {
+		parentBits = BigToCompact(legacyTarget)
+	}
+
+	height := parent.Height + 1
+	if params.NoRetargeting || height%params.RetargetInterval != 0 {
+		return parentBits, nil
+	}
+
+	// 回溯到本调整周期的第一个区块，只需要读取区块头
+	first := parent.BlockHeader
+	for i := 0; i < params.RetargetInterval-1 && len(first.PrevHash) > 0; i++ {
+		header, err := chain.GetHeader(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = header
+	}
+
+	// 限制实际时间的范围，避免目标值一次变化过大
+	expected := params.TargetBlockTime * int64(params.RetargetInterval-1)
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/MaxAdjustFactor {
+		actual = expected / MaxAdjustFactor
+	}
+	if actual > expected*MaxAdjustFactor {
+		actual = expected * MaxAdjustFactor
+	}
+
+	target := CompactToBig(parentBits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(params.PowLimit) > 0 {
+		target.Set(params.PowLimit)
+	}
+
+	return BigToCompact(target), nil
+}
+
+// MedianTimePast 返回以指定区块结尾的最近 MedianTimeBlocks 个区块时间戳的中位数
+func (chain *BlockChain) MedianTimePast(block *Block) (int64, error) {
+	header := block.BlockHeader
+	timestamps := []int64{header.Timestamp}
+
+	for len(timestamps) < MedianTimeBlocks && len(header.PrevHash) > 0 {
+		prev, err := chain.GetHeader(header.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		header = prev
+		timestamps = append(timestamps, header.Timestamp)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
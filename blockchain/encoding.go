@@ -0,0 +1,611 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 规范编码格式
+//
+// 区块、交易和UTXO条目使用与实现语言无关的二进制格式进行哈希、存储和网络传输：
+//   - 定长整数使用小端序，uint32 占 4 字节，int64 占 8 字节
+//   - 变长字节数组和列表先写入 uvarint（LEB128）编码的长度或元素个数，再写入内容
+//   - 顶层结构以 uint32 版本号开头，交易的版本号同时决定交易 ID 的计算方式
+//
+// 各结构按以下顺序编码字段：
+//
+//	TxOutput:    int64 Value | bytes PubKeyHash
+//	TxInput:     bytes ID | int64 Out | bytes Signature | bytes PubKey
+//	Transaction: uint32 Version | bytes ID | uvarint n | n*TxInput | uvarint m | m*TxOutput
+//	BlockHeader: uint32 Version | bytes PrevHash | bytes MerkleRoot | int64 Timestamp | int64 Height |
+//	             uint32 Bits | int64 Nonce
+//	Block:       uint32 blockEncodingVersion | bytes(BlockHeader) | bytes Hash | uvarint n | n*bytes(Transaction)
+//	区块体:      uint32 bodyEncodingVersion | uvarint n | n*bytes(Transaction)
+//	TxProof:     uint32 txProofEncodingVersion | bytes(BlockHeader) | bytes BlockHash | bytes(Transaction) |
+//	             int64 Index | uvarint n | n*bytes Hash
+//	TxOutputs:   uint32 outputsEncodingVersion | uvarint n | n*TxOutput | uvarint m | m*int64 Index |
+//	             int64 Height | byte Coinbase
+//	BlockUndo:   uint32 undoEncodingVersion | uvarint n | n*SpentOutput
+//	SpentOutput: bytes TxID | int64 Index | TxOutput | int64 Height | byte Coinbase
+//	TxLocation:  uint32 txLocationEncodingVersion | bytes BlockHash | int64 Index
+//	AddressTx:   uint32 addressTxEncodingVersion | bytes TxID | int64 Height | int64 Received | int64 Sent
+const (
+	TxVersion = 1 // 新交易的版本，版本 0 的旧交易使用 gob 编码计算交易 ID
+
+	blockEncodingVersion   = 2 // 版本 1 的区块编码没有独立的区块头，解码时仍然支持
+	bodyEncodingVersion    = 1
+	outputsEncodingVersion = 1
+	txProofEncodingVersion = 1
+
+	undoEncodingVersion       = 1
+	txLocationEncodingVersion = 1
+	addressTxEncodingVersion  = 1
+)
+
+// ErrBadEncoding 表示数据不符合规范编码格式
+var ErrBadEncoding = errors.New("malformed canonical encoding")
+
+// encoder 按规范编码格式写入数据
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	e.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func (e *encoder) writeInt64(v int64) {
+	e.Write(binary.LittleEndian.AppendUint64(nil, uint64(v)))
+}
+
+func (e *encoder) writeUvarint(v uint64) {
+	e.Write(binary.AppendUvarint(nil, v))
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUvarint(uint64(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) writeBool(v bool) {
+	if v {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+}
+
+// decoder 按规范编码格式读取数据，遇到第一个错误后的读取都返回零值
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.fail("need %d bytes, have %d", n, len(d.data))
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) readUint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) readInt64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.LittleEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad uvarint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// readCount 读取列表的元素个数，每个元素至少占 minSize 字节，超出剩余数据的个数视为错误
+func (d *decoder) readCount(minSize int) int {
+	n := d.readUvarint()
+	if d.err == nil && n > uint64(len(d.data)/minSize) {
+		d.fail("count %d exceeds remaining data", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readCount(1)
+	if n == 0 {
+		return nil
+	}
+	return append([]byte{}, d.next(n)...)
+}
+
+func (d *decoder) readBool() bool {
+	b := d.next(1)
+	if b == nil {
+		return false
+	}
+	if b[0] > 1 {
+		d.fail("bad bool %d", b[0])
+	}
+	return b[0] == 1
+}
+
+// finish 检查数据是否被完整读取
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+func (out *TxOutput) encode(e *encoder) {
+	e.writeInt64(int64(out.Value))
+	e.writeBytes(out.PubKeyHash)
+}
+
+func (out *TxOutput) decode(d *decoder) {
+	out.Value = int(d.readInt64())
+	out.PubKeyHash = d.readBytes()
+}
+
+func (in *TxInput) encode(e *encoder) {
+	e.writeBytes(in.ID)
+	e.writeInt64(int64(in.Out))
+	e.writeBytes(in.Signature)
+	e.writeBytes(in.PubKey)
+}
+
+func (in *TxInput) decode(d *decoder) {
+	in.ID = d.readBytes()
+	in.Out = int(d.readInt64())
+	in.Signature = d.readBytes()
+	in.PubKey = d.readBytes()
+}
+
+func (tx *Transaction) encode(e *encoder) {
+	e.writeUint32(tx.Version)
+	e.writeBytes(tx.ID)
+	e.writeUvarint(uint64(len(tx.Inputs)))
+	for i := range tx.Inputs {
+		tx.Inputs[i].encode(e)
+	}
+	e.writeUvarint(uint64(len(tx.Outputs)))
+	for i := range tx.Outputs {
+		tx.Outputs[i].encode(e)
+	}
+}
+
+func (tx *Transaction) decode(d *decoder) {
+	tx.Version = d.readUint32()
+	tx.ID = d.readBytes()
+	// 输入至少包含 3 个长度前缀和 8 字节索引，输出至少包含 8 字节金额和 1 个长度前缀
+	tx.Inputs = make([]TxInput, d.readCount(11))
+	for i := range tx.Inputs {
+		tx.Inputs[i].decode(d)
+	}
+	tx.Outputs = make([]TxOutput, d.readCount(9))
+	for i := range tx.Outputs {
+		tx.Outputs[i].decode(d)
+	}
+}
+
+func (h *BlockHeader) encode(e *encoder) {
+	e.writeUint32(h.Version)
+	e.writeBytes(h.PrevHash)
+	e.writeBytes(h.MerkleRoot)
+	e.writeInt64(h.Timestamp)
+	e.writeInt64(int64(h.Height))
+	e.writeUint32(h.Bits)
+	e.writeInt64(int64(h.Nonce)) // 随机数位于最后，挖矿时只需要改写末尾的 8 字节
+}
+
+func (h *BlockHeader) decode(d *decoder) {
+	h.Version = d.readUint32()
+	h.PrevHash = d.readBytes()
+	h.MerkleRoot = d.readBytes()
+	h.Timestamp = d.readInt64()
+	h.Height = int(d.readInt64())
+	h.Bits = d.readUint32()
+	h.Nonce = int(d.readInt64())
+}
+
+func (b *Block) encode(e *encoder) {
+	e.writeUint32(blockEncodingVersion)
+	e.writeBytes(b.BlockHeader.Serialize())
+	e.writeBytes(b.Hash)
+	b.encodeTransactions(e)
+}
+
+func (b *Block) decode(d *decoder) {
+	switch version := d.readUint32(); {
+	case d.err != nil:
+		return
+	case version == 1:
+		// 版本 1 的区块直接保存头部字段，这些区块都使用旧的工作量证明数据
+		b.Timestamp = d.readInt64()
+		b.Hash = d.readBytes()
+		b.PrevHash = d.readBytes()
+		b.Nonce = int(d.readInt64())
+		b.Height = int(d.readInt64())
+		b.Bits = d.readUint32()
+		b.decodeTransactions(d)
+		if d.err == nil && len(b.Transactions) > 0 {
+			b.MerkleRoot = b.HashTransactions()
+		}
+	case version == blockEncodingVersion:
+		header, err := decodeHeader(d.readBytes())
+		if err != nil {
+			d.fail("header: %v", err)
+			return
+		}
+		b.BlockHeader = *header
+		b.Hash = d.readBytes()
+		b.decodeTransactions(d)
+	default:
+		d.fail("unknown block encoding version %d", version)
+	}
+}
+
+// encodeBody 编码不包含区块头的区块体
+func (b *Block) encodeBody(e *encoder) {
+	e.writeUint32(bodyEncodingVersion)
+	b.encodeTransactions(e)
+}
+
+func (b *Block) decodeBody(d *decoder) {
+	if version := d.readUint32(); d.err == nil && version != bodyEncodingVersion {
+		d.fail("unknown block body encoding version %d", version)
+		return
+	}
+	b.decodeTransactions(d)
+}
+
+func (b *Block) encodeTransactions(e *encoder) {
+	e.writeUvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.writeBytes(tx.Serialize())
+	}
+}
+
+func (b *Block) decodeTransactions(d *decoder) {
+	b.Transactions = make([]*Transaction, d.readCount(1))
+	for i := range b.Transactions {
+		tx, err := decodeTransaction(d.readBytes())
+		if err != nil {
+			d.fail("transaction %d: %v", i, err)
+			return
+		}
+		b.Transactions[i] = tx
+	}
+}
+
+func (outs *TxOutputs) encode(e *encoder) {
+	e.writeUint32(outputsEncodingVersion)
+	e.writeUvarint(uint64(len(outs.Outputs)))
+	for i := range outs.Outputs {
+		outs.Outputs[i].encode(e)
+	}
+	e.writeUvarint(uint64(len(outs.Indexes)))
+	for _, index := range outs.Indexes {
+		e.writeInt64(int64(index))
+	}
+	e.writeInt64(int64(outs.Height))
+	e.writeBool(outs.Coinbase)
+}
+
+func (outs *TxOutputs) decode(d *decoder) {
+	if version := d.readUint32(); d.err == nil && version != outputsEncodingVersion {
+		d.fail("unknown outputs encoding version %d", version)
+		return
+	}
+	outs.Outputs = make([]TxOutput, d.readCount(9))
+	for i := range outs.Outputs {
+		outs.Outputs[i].decode(d)
+	}
+	if n := d.readCount(8); n > 0 {
+		outs.Indexes = make([]int, n)
+		for i := range outs.Indexes {
+			outs.Indexes[i] = int(d.readInt64())
+		}
+	}
+	outs.Height = int(d.readInt64())
+	outs.Coinbase = d.readBool()
+}
+
+func (undo *BlockUndo) encode(e *encoder) {
+	e.writeUint32(undoEncodingVersion)
+	e.writeUvarint(uint64(len(undo.Spent)))
+	for i := range undo.Spent {
+		spent := &undo.Spent[i]
+		e.writeBytes(spent.TxID)
+		e.writeInt64(int64(spent.Index))
+		spent.Output.encode(e)
+		e.writeInt64(int64(spent.Height))
+		e.writeBool(spent.Coinbase)
+	}
+}
+
+func (undo *BlockUndo) decode(d *decoder) {
+	if version := d.readUint32(); d.err == nil && version != undoEncodingVersion {
+		d.fail("unknown undo encoding version %d", version)
+		return
+	}
+	if n := d.readCount(27); n > 0 {
+		undo.Spent = make([]SpentOutput, n)
+		for i := range undo.Spent {
+			spent := &undo.Spent[i]
+			spent.TxID = d.readBytes()
+			spent.Index = int(d.readInt64())
+			spent.Output.decode(d)
+			spent.Height = int(d.readInt64())
+			spent.Coinbase = d.readBool()
+		}
+	}
+}
+
+func (location *TxLocation) encode(e *encoder) {
+	e.writeUint32(txLocationEncodingVersion)
+	e.writeBytes(location.BlockHash)
+	e.writeInt64(int64(location.Index))
+}
+
+func (location *TxLocation) decode(d *decoder) {
+	if version := d.readUint32(); d.err == nil && version != txLocationEncodingVersion {
+		d.fail("unknown tx location encoding version %d", version)
+		return
+	}
+	location.BlockHash = d.readBytes()
+	location.Index = int(d.readInt64())
+}
+
+func (atx *AddressTx) encode(e *encoder) {
+	e.writeUint32(addressTxEncodingVersion)
+	e.writeBytes(atx.TxID)
+	e.writeInt64(int64(atx.Height))
+	e.writeInt64(int64(atx.Received))
+	e.writeInt64(int64(atx.Sent))
+}
+
+func (atx *AddressTx) decode(d *decoder) {
+	if version := d.readUint32(); d.err == nil && version != addressTxEncodingVersion {
+		d.fail("unknown address tx encoding version %d", version)
+		return
+	}
+	atx.TxID = d.readBytes()
+	atx.Height = int(d.readInt64())
+	atx.Received = int(d.readInt64())
+	atx.Sent = int(d.readInt64())
+}
+
+func (p *TxProof) encode(e *encoder) {
+	e.writeUint32(txProofEncodingVersion)
+	e.writeBytes(p.Header.Serialize())
+	e.writeBytes(p.BlockHash)
+	e.writeBytes(p.Transaction.Serialize())
+	e.writeInt64(int64(p.Proof.Index))
+	e.writeUvarint(uint64(len(p.Proof.Hashes)))
+	for _, hash := range p.Proof.Hashes {
+		e.writeBytes(hash)
+	}
+}
+
+// decode 解码交易包含证明，叶子哈希由交易重新计算而不是从数据中读取
+func (p *TxProof) decode(d *decoder) {
+	if version := d.readUint32(); d.err == nil && version != txProofEncodingVersion {
+		d.fail("unknown proof encoding version %d", version)
+		return
+	}
+	header, err := decodeHeader(d.readBytes())
+	if err != nil {
+		d.fail("header: %v", err)
+		return
+	}
+	p.Header = *header
+	p.BlockHash = d.readBytes()
+	tx, err := decodeTransaction(d.readBytes())
+	if err != nil {
+		d.fail("transaction: %v", err)
+		return
+	}
+	p.Transaction = *tx
+	p.Proof.Index = int(d.readInt64())
+	p.Proof.Hashes = make([][]byte, d.readCount(1))
+	for i := range p.Proof.Hashes {
+		p.Proof.Hashes[i] = d.readBytes()
+	}
+	p.Proof.Leaf = p.Transaction.MerkleLeaf(p.Header.Version)
+}
+
+// decodeBlock 按规范编码格式解码区块
+func decodeBlock(data []byte) (*Block, error) {
+	var block Block
+	d := &decoder{data: data}
+	block.decode(d)
+	return &block, d.finish()
+}
+
+// decodeBlockBody 按规范编码格式解码区块体，返回的区块只包含交易列表
+func decodeBlockBody(data []byte) (*Block, error) {
+	var block Block
+	d := &decoder{data: data}
+	block.decodeBody(d)
+	return &block, d.finish()
+}
+
+// decodeHeader 按规范编码格式解码区块头
+func decodeHeader(data []byte) (*BlockHeader, error) {
+	var header BlockHeader
+	d := &decoder{data: data}
+	header.decode(d)
+	return &header, d.finish()
+}
+
+// decodeTransaction 按规范编码格式解码交易
+func decodeTransaction(data []byte) (*Transaction, error) {
+	var tx Transaction
+	d := &decoder{data: data}
+	tx.decode(d)
+	return &tx, d.finish()
+}
+
+// decodeOutputs 按规范编码格式解码UTXO条目
+func decodeOutputs(data []byte) (TxOutputs, error) {
+	var outs TxOutputs
+	d := &decoder{data: data}
+	outs.decode(d)
+	return outs, d.finish()
+}
+
+// decodeUndo 按规范编码格式解码区块的撤销数据
+func decodeUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+	d := &decoder{data: data}
+	undo.decode(d)
+	return undo, d.finish()
+}
+
+// decodeTxLocation 按规范编码格式解码交易位置
+func decodeTxLocation(data []byte) (TxLocation, error) {
+	var location TxLocation
+	d := &decoder{data: data}
+	location.decode(d)
+	return location, d.finish()
+}
+
+// decodeAddressTx 按规范编码格式解码地址交易记录
+func decodeAddressTx(data []byte) (AddressTx, error) {
+	var atx AddressTx
+	d := &decoder{data: data}
+	atx.decode(d)
+	return atx, d.finish()
+}
+
+// 旧交易的 gob 编码
+//
+// 版本 0 的交易 ID、签名和 Merkle 根都基于旧版本程序中交易的 gob 编码计算。
+// gob 按照类型在进程中第一次被编码的顺序分配类型 ID，并把类型定义写入编码结果，
+// 直接调用 gob 时结果取决于进程中之前编码过的其它类型，因此这里按照旧版本程序中
+// 交易是第一个被编码的类型时的格式直接写出：固定的类型定义，后面是交易的值。
+
+// legacyTxTypes 是旧交易的 gob 编码开头的类型定义，依次定义 Transaction、[]TxInput、TxInput、[]TxOutput 和 TxOutput
+var legacyTxTypes = hexBytes("387f0301010b5472616e73616374696f6e01ff8000010301024944010a000106496e7075747301ff840001074f75747075747301ff8800000023ff83020101145b5d626c6f636b636861696e2e5478496e70757401ff840001ff8200003dff81030101075478496e70757401ff8200010401024944010a0001034f757401040001095369676e6174757265010a0001065075624b6579010a00000024ff87020101155b5d626c6f636b636861696e2e54784f757470757401ff880001ff8600002fff850301010854784f757470757401ff86000102010556616c7565010400010a5075624b657948617368010a000000")
+
+const legacyTxTypeID = 64 // 类型定义中 Transaction 的类型 ID
+
+// legacyEncoder 按 gob 格式写入旧交易的值
+// 结构体字段以与上一个写入字段的序号差开头，零值字段被省略，结构体以 0 结束
+type legacyEncoder struct {
+	bytes.Buffer
+}
+
+func (e *legacyEncoder) writeUint(v uint64) {
+	if v < 0x80 {
+		e.WriteByte(byte(v))
+		return
+	}
+	b := binary.BigEndian.AppendUint64(nil, v)
+	for b[0] == 0 {
+		b = b[1:]
+	}
+	e.WriteByte(byte(-len(b)))
+	e.Write(b)
+}
+
+func (e *legacyEncoder) writeInt(v int64) {
+	if v < 0 {
+		e.writeUint(uint64(^v)<<1 | 1)
+	} else {
+		e.writeUint(uint64(v) << 1)
+	}
+}
+
+// bytesField 写入 []byte 字段，last 是上一个写入字段的序号
+func (e *legacyEncoder) bytesField(last *int, field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.writeUint(uint64(field - *last))
+	*last = field
+	e.writeUint(uint64(len(b)))
+	e.Write(b)
+}
+
+// intField 写入 int 字段，last 是上一个写入字段的序号
+func (e *legacyEncoder) intField(last *int, field int, v int) {
+	if v == 0 {
+		return
+	}
+	e.writeUint(uint64(field - *last))
+	*last = field
+	e.writeInt(int64(v))
+}
+
+func (e *legacyEncoder) writeTransaction(tx *Transaction) {
+	last := -1
+	e.bytesField(&last, 0, tx.ID)
+	if len(tx.Inputs) > 0 {
+		e.writeUint(uint64(1 - last))
+		last = 1
+		e.writeUint(uint64(len(tx.Inputs)))
+		for _, in := range tx.Inputs {
+			inLast := -1
+			e.bytesField(&inLast, 0, in.ID)
+			e.intField(&inLast, 1, in.Out)
+			e.bytesField(&inLast, 2, in.Signature)
+			e.bytesField(&inLast, 3, in.PubKey)
+			e.WriteByte(0)
+		}
+	}
+	if len(tx.Outputs) > 0 {
+		e.writeUint(uint64(2 - last))
+		e.writeUint(uint64(len(tx.Outputs)))
+		for _, out := range tx.Outputs {
+			outLast := -1
+			e.intField(&outLast, 0, out.Value)
+			e.bytesField(&outLast, 1, out.PubKeyHash)
+			e.WriteByte(0)
+		}
+	}
+	e.WriteByte(0)
+}
+
+// encodeLegacyTransaction 返回交易在旧版本程序中的 gob 编码
+func encodeLegacyTransaction(tx *Transaction) []byte {
+	var value legacyEncoder
+	value.writeInt(legacyTxTypeID)
+	value.writeTransaction(tx)
+
+	var e legacyEncoder
+	e.Write(legacyTxTypes)
+	e.writeUint(uint64(value.Len()))
+	e.Write(value.Bytes())
+	return e.Bytes()
+}
@@ -0,0 +1,69 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestLegacySerialize(t *testing.T) {
+	// 期望值是在新进程中直接使用 gob 编码得到的值部分，前面是固定的类型定义
+	tests := []struct {
+		name string
+		tx   Transaction
+		want string
+	}{
+		{
+			"coinbase",
+			Transaction{[]byte{}, []TxInput{{[]byte{}, -1, nil, []byte("First Transaction from Genesis")}}, []TxOutput{{100, []byte{1, 2}}}, 0},
+			"32ff8002010201021e4669727374205472616e73616374696f6e2066726f6d2047656e6573697300010101ffc8010201020000",
+		},
+		{
+			"zero fields",
+			Transaction{[]byte{0xaa}, []TxInput{{[]byte{1}, 300, []byte{2}, []byte{3}}, {nil, 0, nil, nil}}, []TxOutput{{-5, nil}, {0, []byte{9}}}, 0},
+			"20ff800101aa010201010101fe0258010102010103000001020109000201090000",
+		},
+		{"empty", Transaction{}, "03ff8000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.tx.legacySerialize()
+			if !bytes.HasPrefix(got, legacyTxTypes) {
+				t.Fatal("encoding does not start with the type definitions")
+			}
+			if value := hex.EncodeToString(got[len(legacyTxTypes):]); value != tt.want {
+				t.Fatalf("value = %s, want %s", value, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacySerializeDecodes(t *testing.T) {
+	type Transaction struct {
+		ID      []byte
+		Inputs  []TxInput
+		Outputs []TxOutput
+	}
+
+	for i, value := range []int{1, 127, 128, 255, 256, -64, -65, math.MaxInt64, math.MinInt64} {
+		t.Run(fmt.Sprint(value), func(t *testing.T) {
+			tx := testTx(byte(i))
+			tx.Version = 0
+			tx.Inputs[0].Out = value
+			tx.Outputs[0].Value = value
+			tx.Outputs = append(tx.Outputs, TxOutput{value, bytes.Repeat([]byte{byte(i)}, 200)})
+
+			var decoded Transaction
+			if err := gob.NewDecoder(bytes.NewReader(tx.legacySerialize())).Decode(&decoded); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(decoded) != fmt.Sprint(Transaction{tx.ID, tx.Inputs, tx.Outputs}) {
+				t.Fatalf("decoded %v, want %v", decoded, tx)
+			}
+		})
+	}
+}
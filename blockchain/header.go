@@ -0,0 +1,136 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+)
+
+// HeaderVersion 是新区块头的版本
+// 版本 0 的旧区块头沿用原来的工作量证明数据（前一区块哈希、Merkle 根、随机数和难度），
+// 版本 1 起整个区块头的规范编码就是工作量证明的数据，时间戳和高度也受哈希保护，
+// 版本 2 起 Merkle 树以交易 ID 为叶子，并对叶子和内部节点使用不同的哈希前缀
+const HeaderVersion = 2
+
+var (
+	headerPrefix = []byte("hdr-") // 区块头的键前缀
+	blockPrefix  = []byte("blk-") // 区块体的键前缀
+)
+
+// BlockHeader 表示区块头，区块哈希只由区块头决定
+type BlockHeader struct {
+	Version    uint32 // 区块头版本
+	PrevHash   []byte // 上一个区块的哈希值
+	MerkleRoot []byte // 区块中所有交易的 Merkle 根
+	Timestamp  int64  // 区块创建时间戳
+	Bits       uint32 // 紧凑格式的难度目标，为 0 表示引入难度调整之前的旧区块
+	Nonce      int    // 用于工作量证明（PoW）的随机数
+	Height     int    // 区块高度（区块在区块链中的位置）
+}
+
+// powData 返回使用指定随机数时工作量证明的哈希数据
+func (h *BlockHeader) powData(nonce int) []byte {
+	if h.Version == 0 {
+		// 旧区块没有记录难度目标，使用当时固定的难度值
+		bits := int64(h.Bits)
+		if bits == 0 {
+			bits = Difficulty
+		}
+
+		return bytes.Join(
+			[][]byte{
+				h.PrevHash,          // 前一区块哈希
+				h.MerkleRoot,        // 当前区块交易数据的哈希
+				ToHex(int64(nonce)), // 随机数
+				ToHex(bits),         // 难度目标
+			},
+			[]byte{}, // 空的分隔符
+		)
+	}
+
+	header := *h
+	header.Nonce = nonce
+	return header.Serialize()
+}
+
+// ComputeHash 根据区块头计算区块哈希
+func (h *BlockHeader) ComputeHash() []byte {
+	hash := sha256.Sum256(h.powData(h.Nonce))
+	return hash[:]
+}
+
+// CheckProofOfWork 检查区块头是否与哈希一致且满足自身记录的难度目标
+// 只需要区块头即可完成检查，不需要区块中的交易
+func (h *BlockHeader) CheckProofOfWork(hash []byte) error {
+	if !bytes.Equal(h.ComputeHash(), hash) {
+		return ErrBadBlockHash
+	}
+
+	var intHash big.Int
+	intHash.SetBytes(hash)
+	if intHash.Cmp(h.Target()) >= 0 {
+		return ErrBadProofOfWork
+	}
+
+	return nil
+}
+
+// Serialize 将区块头按规范编码格式序列化为字节数组
+func (h *BlockHeader) Serialize() []byte {
+	var e encoder
+	h.encode(&e)
+
+	return e.Bytes()
+}
+
+// DeserializeHeader 将规范编码的字节数组反序列化为区块头
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	return decodeHeader(data)
+}
+
+// headerKey 返回保存区块头的键
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerPrefix...), hash...)
+}
+
+// blockKey 返回保存区块体的键
+// 区块体不能直接以哈希为键，否则哈希恰好以其它数据的前缀开头时会被当作该类数据
+func blockKey(hash []byte) []byte {
+	return append(append([]byte{}, blockPrefix...), hash...)
+}
+
+// getHeader 在事务中读取指定哈希的区块头
+func getHeader(txn Txn, hash []byte) (*BlockHeader, error) {
+	val, err := txn.Get(headerKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	return decodeHeader(val)
+}
+
+// putBlock 在事务中分别保存区块头和区块体
+func putBlock(txn Txn, block *Block) error {
+	if err := txn.Put(headerKey(block.Hash), block.BlockHeader.Serialize()); err != nil {
+		return err
+	}
+	return txn.Put(blockKey(block.Hash), block.serializeBody())
+}
+
+// GetHeader 获取指定哈希的区块头
+func (chain *BlockChain) GetHeader(blockHash []byte) (BlockHeader, error) {
+	var header *BlockHeader
+
+	err := chain.Database.View(func(txn Txn) error {
+		var err error
+		header, err = getHeader(txn, blockHash)
+		return err
+	})
+	if err == ErrKeyNotFound {
+		return BlockHeader{}, ErrBlockNotFound
+	}
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	return *header, nil
+}
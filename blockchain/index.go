@@ -0,0 +1,291 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var (
+	heightPrefix  = []byte("hi-")     // 主链高度到区块哈希索引的键前缀
+	txIndexPrefix = []byte("tx-")     // 交易 ID 到交易位置索引的键前缀
+	txIndexKey    = []byte("txindex") // 存在该键时表示已启用交易索引
+)
+
+// TxLocation 表示交易在主链中的位置
+type TxLocation struct {
+	BlockHash []byte // 包含该交易的区块哈希
+	Index     int    // 交易在区块中的位置
+}
+
+// heightKey 返回保存指定高度主链区块哈希的键，高度使用大端序编码以保持键的顺序
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+	return key
+}
+
+// txKey 返回保存指定交易位置的键
+func txKey(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+// connectIndexes 在事务中为连接到主链的区块更新索引
+// 需要在UTXO集合连接该区块之后调用，此时区块的撤销数据已经写入
+func (chain *BlockChain) connectIndexes(txn Txn, block *Block) error {
+	if err := txn.Put(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+	if err := chain.connectTxIndex(txn, block); err != nil {
+		return err
+	}
+
+	return chain.connectAddrIndex(txn, block)
+}
+
+// disconnectIndexes 在事务中删除从主链断开的区块的索引
+// 需要在UTXO集合断开该区块之前调用，此时区块的撤销数据尚未删除
+func (chain *BlockChain) disconnectIndexes(txn Txn, block *Block) error {
+	if err := txn.Delete(heightKey(block.Height)); err != nil {
+		return err
+	}
+	if err := chain.disconnectTxIndex(txn, block); err != nil {
+		return err
+	}
+
+	return chain.disconnectAddrIndex(txn, block)
+}
+
+// connectTxIndex 在启用交易索引时记录区块中每笔交易的位置
+func (chain *BlockChain) connectTxIndex(txn Txn, block *Block) error {
+	enabled, err := indexEnabled(txn, txIndexKey)
+	if err != nil || !enabled {
+		return err
+	}
+	for i, tx := range block.Transactions {
+		location := TxLocation{block.Hash, i}
+		if err := txn.Put(txKey(tx.ID), location.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disconnectTxIndex 在启用交易索引时删除区块中交易的位置
+func (chain *BlockChain) disconnectTxIndex(txn Txn, block *Block) error {
+	enabled, err := indexEnabled(txn, txIndexKey)
+	if err != nil || !enabled {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		if err := txn.Delete(txKey(tx.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexEnabled 检查可选索引是否已启用
+func indexEnabled(txn Txn, key []byte) (bool, error) {
+	_, err := txn.Get(key)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// TxIndexEnabled 检查是否已启用交易索引
+func (chain *BlockChain) TxIndexEnabled() (bool, error) {
+	var enabled bool
+
+	err := chain.Database.View(func(txn Txn) error {
+		var err error
+		enabled, err = indexEnabled(txn, txIndexKey)
+		return err
+	})
+
+	return enabled, err
+}
+
+// ReindexTransactions 遍历主链重建交易索引并启用该索引，返回索引的交易数量
+// 启用后区块连接和断开时会自动维护索引，FindTransaction 不再需要遍历整条链
+func (chain *BlockChain) ReindexTransactions() (int, error) {
+	UTXOSet := UTXOSet{chain}
+	if err := UTXOSet.DeleteByPrefix(txIndexPrefix); err != nil {
+		return 0, err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for height := bestHeight; height >= 0; height-- {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return 0, err
+		}
+
+		err = chain.Database.Update(func(txn Txn) error {
+			for i, tx := range block.Transactions {
+				location := TxLocation{block.Hash, i}
+				if err := txn.Put(txKey(tx.ID), location.Serialize()); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		count += len(block.Transactions)
+	}
+
+	err = chain.Database.Update(func(txn Txn) error {
+		return txn.Put(txIndexKey, []byte{1})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// findIndexedTransaction 通过交易索引查找从 blockHash 回溯可达的交易
+// 第二个返回值表示索引能否给出确定的结果，不能时需要回退到遍历区块
+func (chain *BlockChain) findIndexedTransaction(blockHash, ID []byte) (*Transaction, bool, error) {
+	var tx *Transaction
+	usable := false
+
+	err := chain.Database.View(func(txn Txn) error {
+		enabled, err := indexEnabled(txn, txIndexKey)
+		if err != nil || !enabled {
+			return err
+		}
+
+		// 只有起始区块位于主链上时，索引中的主链交易才是它的祖先区块中的交易
+		start, err := getBlock(txn, blockHash)
+		if err != nil {
+			return err
+		}
+		mainHash, err := txn.Get(heightKey(start.Height))
+		if err == ErrKeyNotFound || (err == nil && !bytes.Equal(mainHash, blockHash)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		usable = true
+
+		v, err := txn.Get(txKey(ID))
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		location, err := DeserializeTxLocation(v)
+		if err != nil {
+			return err
+		}
+		block, err := getBlock(txn, location.BlockHash)
+		if err != nil {
+			return err
+		}
+		if block.Height > start.Height || location.Index >= len(block.Transactions) {
+			return nil
+		}
+		tx = block.Transactions[location.Index]
+		return nil
+	})
+
+	return tx, usable, err
+}
+
+// Serialize 将交易位置按规范编码格式序列化为字节数组
+func (location TxLocation) Serialize() []byte {
+	var e encoder
+	location.encode(&e)
+
+	return e.Bytes()
+}
+
+// DeserializeTxLocation 将规范编码的字节数组反序列化为交易位置
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	return decodeTxLocation(data)
+}
+
+// GetBlockHashByHeight 返回主链上指定高度区块的哈希，主链上没有该高度时返回 ErrBlockNotFound
+func (chain *BlockChain) GetBlockHashByHeight(height int) ([]byte, error) {
+	var hash []byte
+
+	err := chain.Database.View(func(txn Txn) error {
+		var err error
+		hash, err = txn.Get(heightKey(height))
+		return err
+	})
+	if err == ErrKeyNotFound {
+		return nil, ErrBlockNotFound
+	}
+
+	return hash, err
+}
+
+// IsMainChain 检查指定哈希的区块是否是主链上 height 高度的区块
+// 区块未知、位于侧链或已经在链重组中被断开时返回 false
+func (chain *BlockChain) IsMainChain(blockHash []byte, height int) (bool, error) {
+	hash, err := chain.GetBlockHashByHeight(height)
+	if err == ErrBlockNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(hash, blockHash), nil
+}
+
+// GetBlockByHeight 返回主链上指定高度的区块
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := chain.GetBlockHashByHeight(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return chain.GetBlock(hash)
+}
+
+// ensureHeightIndex 检查高度索引是否与当前主链一致，不一致时（例如旧版本创建的数据库）
+// 沿主链回溯重建索引
+func (chain *BlockChain) ensureHeightIndex() error {
+	return chain.Database.Update(func(txn Txn) error {
+		tip, err := getBlock(txn, chain.Tip())
+		if err != nil {
+			return err
+		}
+
+		hash, err := txn.Get(heightKey(tip.Height))
+		if err == nil && bytes.Equal(hash, tip.Hash) {
+			return nil
+		}
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+
+		for block := tip; ; {
+			if err := chain.connectIndexes(txn, block); err != nil {
+				return err
+			}
+			if len(block.PrevHash) == 0 {
+				return nil
+			}
+			if block, err = getBlock(txn, block.PrevHash); err != nil {
+				return err
+			}
+		}
+	})
+}
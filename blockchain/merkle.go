@@ -1,10 +1,31 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Merkle 树节点哈希的域分隔前缀，区块头版本 2 起使用
+// 叶子和内部节点使用不同的前缀，内部节点无法被当作叶子（交易）重新解释
+const (
+	merkleLeafTag = 0x00
+	merkleNodeTag = 0x01
+)
 
 // MerkleTree 结构体表示一个 Merkle 树，其中包含树的根节点
 type MerkleTree struct {
 	RootNode *MerkleNode // 树的根节点
+
+	levels [][]MerkleNode // 从叶子层到根的每一层节点（补齐之前），用于生成包含证明
+	leaves int            // 叶子数量
+}
+
+// MerkleProof 证明某个叶子包含在 Merkle 树中
+type MerkleProof struct {
+	Index  int      // 叶子在树中的位置，每一位决定对应层中兄弟节点在左侧还是右侧
+	Leaf   []byte   // 叶子节点的哈希
+	Hashes [][]byte // 从叶子层向上，每一层中兄弟节点的哈希
 }
 
 // MerkleNode 结构体表示 Merkle 树的节点
@@ -14,21 +35,62 @@ type MerkleNode struct {
 	Data  []byte      // 当前节点的数据（哈希值）
 }
 
+// merkleHasher 决定 Merkle 树中叶子和内部节点的哈希方式
+type merkleHasher struct {
+	leaf func(data []byte) []byte
+	node func(left, right []byte) []byte
+}
+
+// legacyMerkle 是区块头版本 0 和 1 使用的哈希方式：
+// 叶子是交易序列化数据的哈希，内部节点是左右子节点哈希拼接后的哈希
+var legacyMerkle = merkleHasher{
+	leaf: func(data []byte) []byte {
+		hash := sha256.Sum256(data)
+		return hash[:]
+	},
+	node: func(left, right []byte) []byte {
+		hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+		return hash[:]
+	},
+}
+
+// taggedMerkle 是区块头版本 2 起使用的哈希方式，叶子和内部节点分别带有域分隔前缀
+var taggedMerkle = merkleHasher{
+	leaf: func(data []byte) []byte {
+		hash := sha256.Sum256(append([]byte{merkleLeafTag}, data...))
+		return hash[:]
+	},
+	node: func(left, right []byte) []byte {
+		hash := sha256.Sum256(append(append([]byte{merkleNodeTag}, left...), right...))
+		return hash[:]
+	},
+}
+
+// merkleHasherFor 返回指定区块头版本使用的 Merkle 哈希方式
+func merkleHasherFor(version uint32) merkleHasher {
+	if version < 2 {
+		return legacyMerkle
+	}
+	return taggedMerkle
+}
+
 // NewMerkleNode 创建一个新的 MerkleNode，计算节点的哈希值
 // 如果是叶子节点（没有子节点），则直接使用数据计算哈希；
 // 否则，通过左右子节点的哈希值计算父节点的哈希。
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	return newMerkleNode(legacyMerkle, left, right, data)
+}
+
+// newMerkleNode 使用指定的哈希方式创建节点
+func newMerkleNode(h merkleHasher, left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
 
 	if left == nil && right == nil {
 		// 如果是叶子节点，直接用数据计算哈希
-		hash := sha256.Sum256(data)
-		node.Data = hash[:] // 存储哈希值
+		node.Data = h.leaf(data)
 	} else {
 		// 如果是父节点，将左右子节点的哈希值拼接后计算哈希
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:] // 存储哈希值
+		node.Data = h.node(left.Data, right.Data)
 	}
 
 	// 设置左右子节点
@@ -39,37 +101,87 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 }
 
 // NewMerkleTree 创建一个新的 MerkleTree，并返回树的根节点
-// 将传入的多组数据计算成 Merkle 树
+// 将传入的多组数据计算成 Merkle 树，使用区块头版本 0 和 1 的哈希方式
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
+	return newMerkleTree(legacyMerkle, data)
+}
 
-	// 如果数据量为奇数，重复最后一个数据项，确保每一层的节点数为偶数
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+// newMerkleTree 使用指定的哈希方式构建 Merkle 树
+// 每一层节点数为奇数时复制该层最后一个节点补齐，因此任意数量的叶子都能得到唯一的根；
+// 与旧实现一致，只有一个叶子时也会与自身合并一次；没有叶子时根为全零哈希
+func newMerkleTree(h merkleHasher, data [][]byte) *MerkleTree {
+	if len(data) == 0 {
+		return &MerkleTree{&MerkleNode{Data: make([]byte, sha256.Size)}, nil, 0}
 	}
 
 	// 先将所有数据创建成叶子节点
+	nodes := make([]MerkleNode, 0, len(data)+1)
 	for _, datum := range data {
-		node := NewMerkleNode(nil, nil, datum) // 创建叶子节点
-		nodes = append(nodes, *node)           // 将节点添加到节点切片中
+		nodes = append(nodes, *newMerkleNode(h, nil, nil, datum))
 	}
 
-	// 从底层开始构建父节点，直到根节点
-	for i := 0; i < len(data)/2; i++ {
-		var newLevel []MerkleNode
+	levels := [][]MerkleNode{nodes}
+
+	// 从底层开始逐层构建父节点，直到只剩根节点
+	for len(levels) == 1 || len(nodes) > 1 {
+		// 如果这一层的节点数为奇数，复制最后一个节点，确保每个节点都有兄弟节点
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
 
 		// 每两个节点合并成一个父节点
+		newLevel := make([]MerkleNode, 0, len(nodes)/2+1)
 		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil) // 创建父节点
-			newLevel = append(newLevel, *node)                  // 添加到新的一层节点
+			node := newMerkleNode(h, &nodes[j], &nodes[j+1], nil) // 创建父节点
+			newLevel = append(newLevel, *node)                    // 添加到新的一层节点
 		}
 
 		// 更新当前节点层次
 		nodes = newLevel
+		levels = append(levels, nodes)
+	}
+
+	// 创建并返回 MerkleTree，根节点是最后一层的唯一节点
+	return &MerkleTree{&nodes[0], levels, len(data)}
+}
+
+// Proof 生成第 index 个叶子的包含证明
+func (t *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	if index < 0 || index >= t.leaves {
+		return nil, fmt.Errorf("leaf index %d out of range [0, %d)", index, t.leaves)
+	}
+
+	proof := &MerkleProof{Index: index, Leaf: t.levels[0][index].Data}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index // 节点数为奇数时最后一个节点与自身组合
+		}
+		proof.Hashes = append(proof.Hashes, level[sibling].Data)
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof 检查包含证明能否从叶子哈希计算出给定的 Merkle 根
+// version 是区块头版本，决定节点的哈希方式；只需要根哈希和证明本身，不需要树中的其它数据
+func VerifyMerkleProof(version uint32, root []byte, proof *MerkleProof) bool {
+	if proof == nil || proof.Index < 0 || proof.Index >= 1<<len(proof.Hashes) {
+		return false
 	}
 
-	// 创建并返回 MerkleTree，根节点是最后一层的第一个节点
-	tree := MerkleTree{&nodes[0]}
+	h := merkleHasherFor(version)
+	hash := proof.Leaf
+	index := proof.Index
+	for _, sibling := range proof.Hashes {
+		if index%2 == 0 {
+			hash = h.node(hash, sibling)
+		} else {
+			hash = h.node(sibling, hash)
+		}
+		index /= 2
+	}
 
-	return &tree
+	return bytes.Equal(hash, root)
 }
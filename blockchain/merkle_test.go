@@ -0,0 +1,231 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testLeaves 返回 n 个互不相同的叶子数据
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("tx-%d", i))
+	}
+	return leaves
+}
+
+// sha 计算拼接后数据的 SHA-256
+func sha(parts ...[]byte) []byte {
+	hash := sha256.Sum256(bytes.Join(parts, nil))
+	return hash[:]
+}
+
+// referenceRoot 按照定义逐层计算 Merkle 根：奇数层复制最后一个节点，单个叶子也与自身合并一次
+func referenceRoot(h merkleHasher, data [][]byte) []byte {
+	if len(data) == 0 {
+		return make([]byte, sha256.Size)
+	}
+
+	level := make([][]byte, len(data))
+	for i, d := range data {
+		level[i] = h.leaf(d)
+	}
+	for first := true; first || len(level) > 1; first = false {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, h.node(level[i], level[i+1]))
+		}
+		level = next
+	}
+
+	return level[0]
+}
+
+func TestMerkleTreeRoot(t *testing.T) {
+	hashers := []struct {
+		name    string
+		version uint32
+	}{
+		{"legacy", 1},
+		{"tagged", HeaderVersion},
+	}
+
+	for _, hs := range hashers {
+		for _, n := range []int{0, 1, 2, 3, 5, 6, 7, 8, 9} {
+			t.Run(fmt.Sprintf("%s/%d", hs.name, n), func(t *testing.T) {
+				h := merkleHasherFor(hs.version)
+				data := testLeaves(n)
+
+				tree := newMerkleTree(h, data)
+				want := referenceRoot(h, data)
+				if !bytes.Equal(tree.RootNode.Data, want) {
+					t.Fatalf("root = %x, want %x", tree.RootNode.Data, want)
+				}
+
+				// 不同的叶子数量（除了奇数层补齐的情况）必须得到不同的根
+				if n > 0 {
+					other := newMerkleTree(h, testLeaves(n-1))
+					if bytes.Equal(tree.RootNode.Data, other.RootNode.Data) {
+						t.Fatalf("%d and %d leaves have the same root", n, n-1)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMerkleTreeLegacyRoots(t *testing.T) {
+	a, b, c, d := []byte("a"), []byte("b"), []byte("c"), []byte("d")
+	ha, hb, hc, hd := sha(a), sha(b), sha(c), sha(d)
+
+	tests := []struct {
+		name string
+		data [][]byte
+		want []byte
+	}{
+		{"1 leaf", [][]byte{a}, sha(ha, ha)},
+		{"2 leaves", [][]byte{a, b}, sha(ha, hb)},
+		{"4 leaves", [][]byte{a, b, c, d}, sha(sha(ha, hb), sha(hc, hd))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewMerkleTree(tt.data).RootNode.Data
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("root = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for _, version := range []uint32{1, HeaderVersion} {
+		for _, n := range []int{1, 2, 3, 5, 6, 7, 8, 9} {
+			t.Run(fmt.Sprintf("v%d/%d", version, n), func(t *testing.T) {
+				tree := newMerkleTree(merkleHasherFor(version), testLeaves(n))
+				root := tree.RootNode.Data
+
+				for i := 0; i < n; i++ {
+					proof, err := tree.Proof(i)
+					if err != nil {
+						t.Fatalf("Proof(%d): %v", i, err)
+					}
+					if !VerifyMerkleProof(version, root, proof) {
+						t.Fatalf("proof of leaf %d does not verify", i)
+					}
+
+					// 修改叶子后证明失效
+					tampered := *proof
+					tampered.Leaf = sha(proof.Leaf)
+					if VerifyMerkleProof(version, root, &tampered) {
+						t.Fatalf("tampered proof of leaf %d verifies", i)
+					}
+				}
+
+				for _, i := range []int{-1, n} {
+					if _, err := tree.Proof(i); err == nil {
+						t.Fatalf("Proof(%d) of %d leaves succeeded", i, n)
+					}
+				}
+			})
+		}
+	}
+
+	if _, err := newMerkleTree(taggedMerkle, nil).Proof(0); err == nil {
+		t.Fatal("Proof(0) of an empty tree succeeded")
+	}
+	if VerifyMerkleProof(HeaderVersion, make([]byte, sha256.Size), nil) {
+		t.Fatal("nil proof verifies")
+	}
+}
+
+// testTx 创建一个花费不存在的输出的交易，只用于检查区块结构
+func testTx(seed byte) *Transaction {
+	tx := Transaction{nil, []TxInput{{[]byte{seed}, 0, nil, []byte{seed}}}, []TxOutput{{1, []byte{seed}}}, TxVersion}
+	tx.ID = tx.Hash()
+	return &tx
+}
+
+func TestDuplicateLastTxMutation(t *testing.T) {
+	params := RegTestParams
+	chain, err := NewBlockChain(NewMemoryStore(), &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.NextBits(&genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range []int{1, 3, 5} {
+		t.Run(fmt.Sprintf("%d txs", count), func(t *testing.T) {
+			coinbase := Transaction{nil, []TxInput{{[]byte{}, -1, nil, []byte("coinbase")}}, []TxOutput{{params.Subsidy(1), unspendablePubKeyHash}}, TxVersion}
+			coinbase.ID = coinbase.Hash()
+			txs := []*Transaction{&coinbase}
+			for i := 1; i < count; i++ {
+				txs = append(txs, testTx(byte(i)))
+			}
+
+			block, err := CreateBlock(context.Background(), txs, genesis.Hash, 1, bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 复制最后一笔交易后 Merkle 根和区块哈希都不变
+			mutated := *block
+			mutated.Transactions = append(append([]*Transaction{}, txs...), txs[len(txs)-1])
+			if !bytes.Equal(mutated.HashTransactions(), block.MerkleRoot) {
+				t.Fatal("mutated block has a different merkle root")
+			}
+
+			err = chain.ValidateBlock(&mutated)
+			if !errors.Is(err, ErrDuplicateTx) {
+				t.Fatalf("ValidateBlock = %v, want %v", err, ErrDuplicateTx)
+			}
+		})
+	}
+}
+
+func FuzzMerkleTree(f *testing.F) {
+	f.Add(uint8(0), uint8(2), []byte("seed"))
+	f.Add(uint8(7), uint8(1), []byte{})
+	f.Add(uint8(33), uint8(2), []byte{0x00, 0x01})
+
+	f.Fuzz(func(t *testing.T, n, version uint8, seed []byte) {
+		data := make([][]byte, n)
+		for i := range data {
+			data[i] = append(append([]byte{}, seed...), byte(i))
+		}
+
+		v := uint32(version % (HeaderVersion + 1))
+		tree := newMerkleTree(merkleHasherFor(v), data)
+		if !bytes.Equal(tree.RootNode.Data, referenceRoot(merkleHasherFor(v), data)) {
+			t.Fatalf("root of %d leaves does not match the reference", n)
+		}
+
+		for i := 0; i < int(n); i++ {
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatalf("Proof(%d): %v", i, err)
+			}
+			if !VerifyMerkleProof(v, tree.RootNode.Data, proof) {
+				t.Fatalf("proof of leaf %d of %d does not verify", i, n)
+			}
+		}
+		if _, err := tree.Proof(int(n)); err == nil {
+			t.Fatalf("Proof(%d) of %d leaves succeeded", n, n)
+		}
+	})
+}
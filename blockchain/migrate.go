@@ -0,0 +1,314 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+)
+
+// dbVersion 是当前数据库格式的版本
+// 版本 0：区块和UTXO条目使用 gob 编码
+// 版本 1：区块和UTXO条目使用规范编码
+// 版本 2：区块头和区块体分开保存
+// 版本 3：区块体以 blockPrefix 为前缀保存，不再直接以区块哈希为键
+// 版本 4：撤销数据、交易索引和地址索引使用规范编码
+const dbVersion = 4
+
+var dbVersionKey = []byte("dbversion") // 保存数据库格式版本的键
+
+// legacyBlock 是版本 0 数据库中使用 gob 编码保存的区块
+type legacyBlock struct {
+	Timestamp    int64
+	Hash         []byte
+	Transactions []*Transaction
+	PrevHash     []byte
+	Nonce        int
+	Height       int
+	Bits         uint32
+}
+
+// toBlock 将旧区块转换为区块头版本为 0 的区块
+func (old legacyBlock) toBlock() *Block {
+	header := BlockHeader{0, old.PrevHash, nil, old.Timestamp, old.Bits, old.Nonce, old.Height}
+	block := &Block{header, old.Hash, old.Transactions}
+	if len(block.Transactions) > 0 {
+		block.MerkleRoot = block.HashTransactions()
+	}
+	return block
+}
+
+// setDBVersion 在事务中记录数据库格式版本
+func setDBVersion(txn Txn, version uint32) error {
+	return txn.Put(dbVersionKey, binary.BigEndian.AppendUint32(nil, version))
+}
+
+// migrate 将旧版本的数据库升级到当前格式
+func (chain *BlockChain) migrate() error {
+	var version uint32
+
+	err := chain.Database.View(func(txn Txn) error {
+		v, err := txn.Get(dbVersionKey)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		version = binary.BigEndian.Uint32(v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if version > dbVersion {
+		return fmt.Errorf("database version %d is newer than supported version %d", version, dbVersion)
+	}
+
+	// 每一步完成后立即记录版本，进程在升级过程中退出时下次从未完成的那一步继续
+	// 每一步都跳过已经是新格式的数据，重新执行中断的步骤是安全的
+	migrations := []struct {
+		version uint32
+		run     func() error
+	}{
+		{1, chain.migrateCanonicalEncoding},
+		{2, chain.migrateBlockHeaders},
+		{3, chain.migrateBlockBodies},
+		{4, chain.migrateRecordEncoding},
+	}
+	for _, m := range migrations {
+		if version >= m.version {
+			continue
+		}
+		if err := m.run(); err != nil {
+			return err
+		}
+		err := chain.Database.Update(func(txn Txn) error {
+			return setDBVersion(txn, m.version)
+		})
+		if err != nil {
+			return err
+		}
+		version = m.version
+	}
+
+	return nil
+}
+
+// migrateCanonicalEncoding 将 gob 编码的区块和UTXO条目重新编码为规范编码
+// 区块以 32 字节的哈希作为键，其它数据都带有前缀
+func (chain *BlockChain) migrateCanonicalEncoding() error {
+	fmt.Println("Migrating database to canonical encoding...")
+
+	batch := chain.Database.NewBatch()
+	defer batch.Cancel()
+
+	blocks, entries := 0, 0
+	err := chain.Database.View(func(txn Txn) error {
+		return txn.Iterate(nil, false, func(key, v []byte) error {
+			isBlock := len(key) == 32
+			isUTXO := bytes.HasPrefix(key, utxoPrefix)
+			if !isBlock && !isUTXO {
+				return nil
+			}
+
+			var data []byte
+			if isBlock {
+				// 上次中断前已经重新编码或已经拆分出区块头的区块
+				if _, err := decodeBlock(v); err == nil {
+					return nil
+				}
+				if _, err := decodeBlockBody(v); err == nil {
+					return nil
+				}
+
+				var old legacyBlock
+				if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&old); err != nil {
+					return fmt.Errorf("block %x: %w", key, err)
+				}
+				data = old.toBlock().Serialize()
+				blocks++
+			} else {
+				if _, err := decodeOutputs(v); err == nil {
+					return nil
+				}
+
+				var outs TxOutputs
+				if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&outs); err != nil {
+					return fmt.Errorf("utxo %x: %w", key[len(utxoPrefix):], err)
+				}
+				data = outs.Serialize()
+				entries++
+			}
+
+			return batch.Put(key, data)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %d blocks and %d UTXO entries\n", blocks, entries)
+	return nil
+}
+
+// migrateBlockHeaders 将以区块哈希为键保存的完整区块拆分为区块头和区块体
+func (chain *BlockChain) migrateBlockHeaders() error {
+	fmt.Println("Migrating database to separate block headers...")
+
+	batch := chain.Database.NewBatch()
+	defer batch.Cancel()
+
+	blocks := 0
+	err := chain.Database.View(func(txn Txn) error {
+		return txn.Iterate(nil, false, func(key, v []byte) error {
+			if len(key) != 32 {
+				return nil
+			}
+
+			block, err := decodeBlock(v)
+			if err != nil {
+				// 上次中断前已经拆分的区块只剩区块体，区块头在区块体之前写入
+				if _, bodyErr := decodeBlockBody(v); bodyErr == nil {
+					return nil
+				}
+				return fmt.Errorf("block %x: %w", key, err)
+			}
+
+			if err := batch.Put(headerKey(key), block.BlockHeader.Serialize()); err != nil {
+				return err
+			}
+			if err := batch.Put(key, block.serializeBody()); err != nil {
+				return err
+			}
+			blocks++
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %d blocks\n", blocks)
+	return nil
+}
+
+// migrateBlockBodies 将以区块哈希为键保存的区块体移动到 blockPrefix 前缀下
+// 之前的版本中以哈希为键的区块可能与带前缀的索引键冲突，按前缀删除索引时会误删区块
+// 新键在删除旧键之前写入，中断后重新执行时仍然留在旧键下的区块会被再次移动
+func (chain *BlockChain) migrateBlockBodies() error {
+	fmt.Println("Migrating database to prefixed block keys...")
+
+	batch := chain.Database.NewBatch()
+	defer batch.Cancel()
+
+	blocks := 0
+	err := chain.Database.View(func(txn Txn) error {
+		return txn.Iterate(nil, false, func(key, v []byte) error {
+			if len(key) != 32 {
+				return nil
+			}
+
+			if err := batch.Put(blockKey(key), v); err != nil {
+				return err
+			}
+			if err := batch.Delete(key); err != nil {
+				return err
+			}
+			blocks++
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %d blocks\n", blocks)
+	return nil
+}
+
+// migrateRecordEncoding 将 gob 编码的撤销数据、交易索引和地址索引记录重新编码为规范编码
+// 已经是规范编码的记录保持不变
+func (chain *BlockChain) migrateRecordEncoding() error {
+	fmt.Println("Migrating undo data and indexes to canonical encoding...")
+
+	// 每种记录的前缀和转换函数，转换函数对已经是规范编码的记录返回 nil
+	kinds := []struct {
+		prefix  []byte
+		convert func(v []byte) ([]byte, error)
+	}{
+		{undoPrefix, func(v []byte) ([]byte, error) {
+			if _, err := decodeUndo(v); err == nil {
+				return nil, nil
+			}
+			var undo BlockUndo
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&undo); err != nil {
+				return nil, err
+			}
+			return undo.Serialize(), nil
+		}},
+		{txIndexPrefix, func(v []byte) ([]byte, error) {
+			if _, err := decodeTxLocation(v); err == nil {
+				return nil, nil
+			}
+			var location TxLocation
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&location); err != nil {
+				return nil, err
+			}
+			return location.Serialize(), nil
+		}},
+		{addrIndexPrefix, func(v []byte) ([]byte, error) {
+			if _, err := decodeAddressTx(v); err == nil {
+				return nil, nil
+			}
+			var atx AddressTx
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&atx); err != nil {
+				return nil, err
+			}
+			return atx.Serialize(), nil
+		}},
+	}
+
+	batch := chain.Database.NewBatch()
+	defer batch.Cancel()
+
+	records := 0
+	err := chain.Database.View(func(txn Txn) error {
+		for _, kind := range kinds {
+			err := txn.Iterate(kind.prefix, false, func(key, v []byte) error {
+				data, err := kind.convert(v)
+				if err != nil {
+					return fmt.Errorf("%s%x: %w", kind.prefix, key[len(kind.prefix):], err)
+				}
+				if data == nil {
+					return nil
+				}
+				records++
+				return batch.Put(key, data)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %d records\n", records)
+	return nil
+}
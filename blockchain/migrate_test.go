@@ -0,0 +1,151 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+)
+
+// legacyRecords 返回版本 0 数据库中使用 gob 编码的撤销数据、交易索引和地址索引记录
+func legacyRecords(genesis *Block) map[string]interface{} {
+	coinbase := genesis.Transactions[0]
+	out := coinbase.Outputs[0]
+
+	return map[string]interface{}{
+		string(undoKey(genesis.Hash)):                   BlockUndo{[]SpentOutput{{coinbase.ID, 0, out, 0, true}}},
+		string(txKey(coinbase.ID)):                      TxLocation{genesis.Hash, 0},
+		string(addrKey(out.PubKeyHash, 0, coinbase.ID)): AddressTx{coinbase.ID, 0, out.Value, 0},
+	}
+}
+
+// legacyStore 返回只包含创世区块的版本 0 数据库，区块、UTXO条目和其它记录使用 gob 编码
+func legacyStore(t *testing.T, params *ChainParams) Store {
+	genesis, err := params.GenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+
+	old := legacyBlock{genesis.Timestamp, genesis.Hash, genesis.Transactions, genesis.PrevHash, genesis.Nonce, genesis.Height, genesis.Bits}
+	outs := TxOutputs{Outputs: coinbase.Outputs, Indexes: []int{0}, Coinbase: true}
+
+	var block, entry bytes.Buffer
+	if err := gob.NewEncoder(&block).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(&entry).Encode(outs); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryStore()
+	err = store.Update(func(txn Txn) error {
+		if err := txn.Put(genesis.Hash, block.Bytes()); err != nil {
+			return err
+		}
+		if err := txn.Put(append(append([]byte{}, utxoPrefix...), coinbase.ID...), entry.Bytes()); err != nil {
+			return err
+		}
+		for key, record := range legacyRecords(genesis) {
+			var data bytes.Buffer
+			if err := gob.NewEncoder(&data).Encode(record); err != nil {
+				return err
+			}
+			if err := txn.Put([]byte(key), data.Bytes()); err != nil {
+				return err
+			}
+		}
+		return txn.Put([]byte("lh"), genesis.Hash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestMigrateResume(t *testing.T) {
+	params := MainNetParams
+
+	tests := []struct {
+		name string
+		done func(chain *BlockChain) []func() error // 中断前已经完成的步骤
+	}{
+		{"fresh", func(chain *BlockChain) []func() error { return nil }},
+		{"after encoding", func(chain *BlockChain) []func() error {
+			return []func() error{chain.migrateCanonicalEncoding}
+		}},
+		{"after headers", func(chain *BlockChain) []func() error {
+			return []func() error{chain.migrateCanonicalEncoding, chain.migrateBlockHeaders}
+		}},
+		{"after bodies", func(chain *BlockChain) []func() error {
+			return []func() error{chain.migrateCanonicalEncoding, chain.migrateBlockHeaders, chain.migrateBlockBodies}
+		}},
+		{"after records", func(chain *BlockChain) []func() error {
+			return []func() error{chain.migrateCanonicalEncoding, chain.migrateBlockHeaders, chain.migrateBlockBodies, chain.migrateRecordEncoding}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := legacyStore(t, &params)
+
+			// 没有记录版本就退出的升级，下次打开时从头重新执行
+			partial := &BlockChain{Database: store, Params: &params}
+			for _, step := range tt.done(partial) {
+				if err := step(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			chain, err := LoadBlockChain(store, &params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, err := chain.GetBlock(params.Genesis.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(block.ComputeHash(), params.Genesis.Hash) {
+				t.Fatalf("migrated genesis hashes to %x", block.ComputeHash())
+			}
+			if !hasOutput(t, chain, block.Transactions[0].ID) {
+				t.Fatal("genesis output is missing from the UTXO set")
+			}
+
+			// 其它记录被重新编码为规范编码
+			for key, want := range legacyRecords(&block) {
+				err := store.View(func(txn Txn) error {
+					v, err := txn.Get([]byte(key))
+					if err != nil {
+						return err
+					}
+
+					var got interface{}
+					switch want.(type) {
+					case BlockUndo:
+						got, err = DeserializeUndo(v)
+					case TxLocation:
+						got, err = DeserializeTxLocation(v)
+					case AddressTx:
+						got, err = DeserializeAddressTx(v)
+					}
+					if err != nil {
+						return err
+					}
+					if fmt.Sprint(got) != fmt.Sprint(want) {
+						return fmt.Errorf("got %v, want %v", got, want)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("record %q: %v", key, err)
+				}
+			}
+
+			// 升级完成后再次打开不需要任何修改
+			if _, err := LoadBlockChain(store, &params); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
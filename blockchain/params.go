@@ -0,0 +1,221 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"path/filepath"
+)
+
+// ChainParams 定义一个区块链网络的参数
+// 不同网络的区块、地址和网络消息互不兼容，修改共识相关的参数后需要重新创建区块链
+type ChainParams struct {
+	Name           string  // 网络名称，主网以外的网络数据保存在数据目录下的同名子目录中
+	Magic          [4]byte // 网络消息的魔数，用于区分不同网络的消息
+	DefaultPort    string  // 节点默认监听的端口
+	AddressVersion byte    // 地址的版本号
+
+	Genesis GenesisParams // 网络的创世区块
+
+	InitialSubsidy  int // 创世区块及第一个减半周期内每个区块的奖励
+	HalvingInterval int // 每隔多少个区块奖励减半，不大于 0 时奖励不减半
+
+	// CoinbaseMaturity 是 coinbase 输出可以被花费之前需要经过的区块数量，
+	// 避免链重组使已经花费的挖矿奖励失效
+	CoinbaseMaturity int
+
+	PowLimit         *big.Int // 允许的最大目标值（最低难度）
+	TargetBlockTime  int64    // 期望的出块间隔（秒）
+	RetargetInterval int      // 每隔多少个区块重新计算一次难度目标
+	NoRetargeting    bool     // 为 true 时难度目标始终保持创世区块的值
+}
+
+// GenesisParams 描述网络的创世区块
+// 创世区块不需要挖矿，所有节点根据这些参数构造出完全相同的区块，网络握手时双方比较创世区块哈希
+type GenesisParams struct {
+	Version    uint32 // 区块头版本
+	TxVersion  uint32 // coinbase 交易的版本
+	Timestamp  int64  // 区块时间戳
+	Bits       uint32 // 难度目标，为 0 表示引入难度调整之前的固定难度
+	Nonce      int    // 满足工作量证明的随机数
+	Data       string // coinbase 交易输入中的数据
+	PubKeyHash []byte // 接收创世区块奖励的公钥哈希
+	Hash       []byte // 创世区块的哈希
+}
+
+// unspendablePubKeyHash 没有对应的私钥，支付给它的输出无法被花费
+var unspendablePubKeyHash = make([]byte, 20)
+
+// MainNetParams 是主网的参数，与引入网络参数之前的区块链保持兼容
+// 创世区块就是仓库中 blocks_3000 数据库里的创世区块
+var MainNetParams = ChainParams{
+	Name:           "mainnet",
+	Magic:          [4]byte{0xf1, 0xb2, 0xc3, 0xd4},
+	DefaultPort:    "3000",
+	AddressVersion: 0x00,
+
+	Genesis: GenesisParams{
+		Version:    0,
+		TxVersion:  0,
+		Timestamp:  1735834656,
+		Bits:       0,
+		Nonce:      120778,
+		Data:       "First Transaction from Genesis",
+		PubKeyHash: hexBytes("d41909baeba4b46ba7ab974f5de3cfc8c2512f75"),
+		Hash:       hexBytes("0000337b4b2c4570c86fbb2b50fd0dd53992cac528927b6553c50d0a56d9f69c"),
+	},
+
+	InitialSubsidy:   100,
+	HalvingInterval:  210,
+	CoinbaseMaturity: 10,
+
+	PowLimit:         new(big.Int).Lsh(big.NewInt(1), 256-12),
+	TargetBlockTime:  10,
+	RetargetInterval: 10,
+}
+
+// TestNetParams 是测试网络的参数，挖矿难度较低
+var TestNetParams = ChainParams{
+	Name:           "testnet",
+	Magic:          [4]byte{0x0b, 0x11, 0x09, 0x07},
+	DefaultPort:    "13000",
+	AddressVersion: 0x6f,
+
+	Genesis: GenesisParams{
+		Version:    HeaderVersion,
+		TxVersion:  TxVersion,
+		Timestamp:  1792108800,
+		Bits:       BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-16)),
+		Nonce:      60269,
+		Data:       "First Transaction from Testnet Genesis",
+		PubKeyHash: unspendablePubKeyHash,
+		Hash:       hexBytes("00005643b74f9aef2aa2592b0e756382e48e181f62b876e255e3b534ee082451"),
+	},
+
+	InitialSubsidy:   100,
+	HalvingInterval:  210,
+	CoinbaseMaturity: 10,
+
+	PowLimit:         new(big.Int).Lsh(big.NewInt(1), 256-12),
+	TargetBlockTime:  10,
+	RetargetInterval: 10,
+}
+
+// regTestPowLimit 是回归测试网络的目标值，大约每两次哈希就能找到一个有效区块
+var regTestPowLimit = new(big.Int).Lsh(big.NewInt(1), 255)
+
+// RegTestParams 是本地回归测试网络的参数，只用于在本机搭建测试网络
+// 工作量证明几乎没有难度且不调整难度，可以通过 generate 命令立即生成任意数量的区块
+var RegTestParams = ChainParams{
+	Name:           "regtest",
+	Magic:          [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	DefaultPort:    "23000",
+	AddressVersion: 0x6f,
+
+	Genesis: GenesisParams{
+		Version:    HeaderVersion,
+		TxVersion:  TxVersion,
+		Timestamp:  1792108800,
+		Bits:       BigToCompact(regTestPowLimit),
+		Nonce:      0,
+		Data:       "First Transaction from Regtest Genesis",
+		PubKeyHash: unspendablePubKeyHash,
+		Hash:       hexBytes("31076120f28c07ab604574aafd292713fa80f6695a91d1f2d3e562a442c3ce61"),
+	},
+
+	InitialSubsidy:   100,
+	HalvingInterval:  150,
+	CoinbaseMaturity: 10,
+
+	PowLimit:         regTestPowLimit,
+	TargetBlockTime:  10,
+	RetargetInterval: 10,
+	NoRetargeting:    true,
+}
+
+// networks 包含所有预定义网络的参数，按名称查找
+var networks = []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams}
+
+// ParamsForNetwork 返回指定名称的网络参数，名称未知时返回错误
+func ParamsForNetwork(name string) (*ChainParams, error) {
+	for _, params := range networks {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+// DataDir 返回该网络在数据根目录 root 中使用的数据目录
+// 主网直接使用根目录，其它网络使用以网络名称命名的子目录，避免不同网络的数据混在一起
+func (p *ChainParams) DataDir(root string) string {
+	if p.Name == MainNetParams.Name {
+		return root
+	}
+	return filepath.Join(root, p.Name)
+}
+
+// GenesisBlock 根据网络参数构造创世区块
+// 构造出的区块与参数中记录的哈希不一致或不满足工作量证明时返回错误
+func (p *ChainParams) GenesisBlock() (*Block, error) {
+	g := p.Genesis
+
+	txin := TxInput{[]byte{}, -1, nil, []byte(g.Data)}
+	txout := TxOutput{p.Subsidy(0), g.PubKeyHash}
+	coinbase := Transaction{nil, []TxInput{txin}, []TxOutput{txout}, g.TxVersion}
+	coinbase.ID = coinbase.Hash()
+
+	header := BlockHeader{g.Version, []byte{}, nil, g.Timestamp, g.Bits, g.Nonce, 0}
+	block := &Block{header, nil, []*Transaction{&coinbase}}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.ComputeHash()
+
+	if !bytes.Equal(block.Hash, g.Hash) {
+		return nil, fmt.Errorf("%s genesis block hashes to %x, expected %x", p.Name, block.Hash, g.Hash)
+	}
+	if err := block.CheckProofOfWork(block.Hash); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// hexBytes 解码参数中的十六进制常量
+func hexBytes(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Subsidy 返回指定高度的区块允许通过 coinbase 发行的新币数量
+// 奖励每 HalvingInterval 个区块减半一次，减为 0 后不再发行新币
+func (p *ChainParams) Subsidy(height int) int {
+	if p.HalvingInterval <= 0 {
+		return p.InitialSubsidy
+	}
+
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return p.InitialSubsidy >> uint(halvings)
+}
+
+// MaxSupply 返回按照奖励规则最终能够发行的货币总量
+func (p *ChainParams) MaxSupply() int {
+	if p.HalvingInterval <= 0 {
+		return -1 // 奖励不减半时没有上限
+	}
+
+	supply := 0
+	for subsidy := p.InitialSubsidy; subsidy > 0; subsidy >>= 1 {
+		supply += subsidy * p.HalvingInterval
+	}
+
+	return supply
+}
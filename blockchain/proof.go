@@ -1,18 +1,28 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// 挖矿的难度（目标哈希的前几位必须是 0，数字越大难度越高）
+// 引入难度调整之前固定使用的挖矿难度（目标哈希的前几位必须是 0），
+// 同时作为新区块链的初始难度，之后的难度目标记录在区块的 Bits 中
 const Difficulty = 18
 
+const (
+	hashBatch        = 1 << 12         // 每个工作协程检查取消信号和统计算力的间隔（哈希次数）
+	hashrateInterval = 5 * time.Second // 输出算力的时间间隔
+)
+
 // ProofOfWork 结构体，用于工作量证明（PoW）算法
 type ProofOfWork struct {
 	Block  *Block   // 当前区块
@@ -22,54 +32,138 @@ type ProofOfWork struct {
 // NewProof 创建一个新的工作量证明
 // 输入为区块，返回包含目标值和区块的 ProofOfWork 对象
 func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	// 左移操作，调整目标值以满足难度要求
-	target.Lsh(target, uint(256-Difficulty)) // Lsh: 左移位数
-
-	pow := &ProofOfWork{b, target}
+	// 目标值由区块头中的难度目标决定
+	pow := &ProofOfWork{b, b.Target()}
 	return pow
 }
 
 // InitData 初始化数据，用于生成哈希值
-// 包含前一区块哈希、交易数据的哈希值、随机数（nonce）和难度值
+// 新区块使用整个区块头的规范编码，旧区块包含前一区块哈希、Merkle 根、随机数（nonce）和难度目标
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,           // 前一区块哈希
-			pow.Block.HashTransactions(), // 当前区块交易数据的哈希
-			ToHex(int64(nonce)),          // 随机数
-			ToHex(int64(Difficulty)),     // 难度值
-		},
-		[]byte{}, // 空的分隔符
-	)
-	return data
+	return pow.Block.powData(nonce)
 }
 
 // Run 执行工作量证明算法
 // 寻找满足条件的随机数（nonce），返回随机数和对应的哈希值
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int // 用于存储哈希值的整数表示
-	var hash [32]byte   // 当前计算的哈希值
-
-	nonce := 0 // 随机数从 0 开始
-
-	// 不断尝试随机数，直到找到满足条件的哈希值或达到最大值
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)    // 初始化数据
-		hash = sha256.Sum256(data)     // 计算哈希值
-		fmt.Printf("\r%x", hash)       // 打印当前哈希值（动态更新）
-		intHash.SetBytes(hash[:])      // 将哈希值转换为大整数
-
-		// 如果当前哈希值小于目标值，说明找到合适的随机数
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++ // 否则增加随机数继续尝试
+func (pow *ProofOfWork) Run() (int, []byte, error) {
+	return pow.RunContext(context.Background())
+}
+
+// RunContext 使用所有 CPU 核心并行执行工作量证明算法
+// 随机数空间按照工作协程数量交错划分，ctx 被取消时（例如网络上出现了新的链头）
+// 立即停止挖矿并返回 ctx 的错误；挖矿期间定期输出算力
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
+	type result struct {
+		nonce int
+		hash  []byte
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	workers := runtime.NumCPU()
+	found := make(chan result, workers)
+	var hashes uint64
+	var wg sync.WaitGroup
+
+	// 数据中只有随机数部分会变化，其余部分只需计算一次
+	prefix, suffix, order := pow.dataParts()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+
+			var intHash big.Int
+			data := make([]byte, 0, len(prefix)+8+len(suffix))
+			data = append(data, prefix...)
+			data = append(data, make([]byte, 8)...)
+			data = append(data, suffix...)
+			nonceBytes := data[len(prefix) : len(prefix)+8]
+
+			for nonce, n := start, 0; nonce >= 0 && nonce < math.MaxInt64; nonce, n = nonce+workers, n+1 {
+				// 定期检查是否需要停止并累计算力
+				if n%hashBatch == 0 && n > 0 {
+					atomic.AddUint64(&hashes, hashBatch)
+					select {
+					case <-ctx.Done():
+						return
+					default:
+					}
+				}
+
+				order.PutUint64(nonceBytes, uint64(nonce))
+				hash := sha256.Sum256(data)
+				intHash.SetBytes(hash[:])
+
+				// 如果当前哈希值小于目标值，说明找到合适的随机数
+				if intHash.Cmp(pow.Target) == -1 {
+					found <- result{nonce, hash[:]}
+					cancel()
+					return
+				}
+			}
+		}(w)
+	}
+
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	started := time.Now()
+	ticker := time.NewTicker(hashrateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case res, ok := <-found:
+			elapsed := time.Since(started)
+			if !ok {
+				// 所有工作协程都已退出且没有找到结果
+				if err := parent.Err(); err != nil {
+					fmt.Printf("Mining aborted after %s\n", elapsed.Round(time.Millisecond))
+					return 0, nil, err
+				}
+				return 0, nil, errors.New("nonce space exhausted")
+			}
+			fmt.Printf("Found nonce %d in %s (%s)\n", res.nonce, elapsed.Round(time.Millisecond), formatHashrate(atomic.LoadUint64(&hashes), elapsed))
+			return res.nonce, res.hash, nil
+		case <-ticker.C:
+			fmt.Printf("Mining... %s\n", formatHashrate(atomic.LoadUint64(&hashes), time.Since(started)))
 		}
 	}
-	fmt.Println() // 打印空行
+}
+
+// dataParts 将 InitData 的数据拆分为随机数之前和之后的两部分，并返回随机数的字节序
+func (pow *ProofOfWork) dataParts() ([]byte, []byte, binary.ByteOrder) {
+	data := pow.InitData(0)
+	if pow.Block.Version == 0 {
+		prefixLen := len(data) - 16 // 随机数和难度目标各占 8 字节，使用大端序
+		return data[:prefixLen], data[prefixLen+8:], binary.BigEndian
+	}
 
-	return nonce, hash[:] // 返回找到的随机数和哈希值
+	// 区块头的规范编码以小端序的随机数结尾
+	return data[:len(data)-8], nil, binary.LittleEndian
+}
+
+// formatHashrate 根据哈希次数和耗时格式化算力
+func formatHashrate(hashes uint64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "0 H/s"
+	}
+	rate := float64(hashes) / elapsed.Seconds()
+
+	switch {
+	case rate >= 1e9:
+		return fmt.Sprintf("%.2f GH/s", rate/1e9)
+	case rate >= 1e6:
+		return fmt.Sprintf("%.2f MH/s", rate/1e6)
+	case rate >= 1e3:
+		return fmt.Sprintf("%.2f kH/s", rate/1e3)
+	}
+	return fmt.Sprintf("%.0f H/s", rate)
 }
 
 // Validate 验证区块是否满足工作量证明的条件
@@ -88,10 +182,16 @@ func (pow *ProofOfWork) Validate() bool {
 // ToHex 将整数转换为字节数组（大端序）
 // 用于生成哈希时的输入数据
 func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)                              // 创建缓冲区
-	err := binary.Write(buff, binary.BigEndian, num)       // 写入整数（大端序）
-	if err != nil {
-		log.Panic(err) // 如果写入失败，记录日志并终止程序
-	}
-	return buff.Bytes() // 返回字节数组
+	return binary.BigEndian.AppendUint64(nil, uint64(num)) // 写入整数（大端序）
+}
+
+// Work 返回区块代表的工作量，即找到满足目标值的哈希平均需要尝试的次数
+// 计算方式为 2^256 / (target + 1)
+func (h *BlockHeader) Work() *big.Int {
+	target := h.Target()
+
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return numerator.Div(numerator, denominator)
 }
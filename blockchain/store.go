@@ -0,0 +1,42 @@
+package blockchain
+
+import "errors"
+
+// ErrKeyNotFound 表示存储中不存在指定的键
+var ErrKeyNotFound = errors.New("key not found")
+
+// Store 是区块链使用的键值存储
+// 区块链、迭代器和UTXO集合只通过该接口访问数据，可以使用 badger 或内存实现
+type Store interface {
+	// View 在只读事务中执行 fn
+	View(fn func(txn Txn) error) error
+	// Update 在读写事务中执行 fn，fn 返回错误时事务中的所有修改都被丢弃
+	Update(fn func(txn Txn) error) error
+	// NewBatch 创建一个批量写入，适合一次写入大量数据，写入不保证原子性
+	NewBatch() Batch
+	// Close 关闭存储
+	Close() error
+}
+
+// Txn 表示存储上的一个事务，事务中的读取可以看到该事务之前的写入
+type Txn interface {
+	// Get 返回键对应值的副本，键不存在时返回 ErrKeyNotFound
+	Get(key []byte) ([]byte, error)
+	// Put 写入键值对，只读事务中调用会返回错误
+	Put(key, value []byte) error
+	// Delete 删除键，键不存在时不返回错误
+	Delete(key []byte) error
+	// Iterate 按键的顺序遍历以 prefix 开头的所有键值对，reverse 为 true 时从大到小遍历
+	// prefix 为空时遍历所有键；key 和 value 只在 fn 调用期间有效，fn 返回错误时停止遍历
+	Iterate(prefix []byte, reverse bool, fn func(key, value []byte) error) error
+}
+
+// Batch 表示一组批量写入，调用 Flush 后才会写入存储
+type Batch interface {
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Flush 写入所有操作
+	Flush() error
+	// Cancel 丢弃尚未写入的操作
+	Cancel()
+}
@@ -0,0 +1,186 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// BadgerStore 是基于 badger 数据库的存储实现
+type BadgerStore struct {
+	db *badger.DB
+}
+
+// OpenBadgerStore 打开或创建指定目录中的 badger 数据库
+func OpenBadgerStore(path string) (*BadgerStore, error) {
+	// 初始化 Badger 数据库选项
+	opts := badger.DefaultOptions(path).
+		WithLogger(nil).               // 禁用日志
+		WithLoggingLevel(badger.ERROR) // 只显示错误日志
+	opts.Dir = path
+	opts.ValueDir = path
+
+	db, err := openDB(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BadgerStore{db}, nil
+}
+
+// View 在 badger 只读事务中执行 fn
+func (s *BadgerStore) View(fn func(txn Txn) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+// Update 在 badger 读写事务中执行 fn
+func (s *BadgerStore) Update(fn func(txn Txn) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+// NewBatch 创建一个 badger 批量写入
+func (s *BadgerStore) NewBatch() Batch {
+	return badgerBatch{s.db.NewWriteBatch()}
+}
+
+// Close 关闭 badger 数据库
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+// badgerTxn 将 badger 事务适配为 Txn
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Put(key, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t badgerTxn) Iterate(prefix []byte, reverse bool, fn func(key, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = reverse
+
+	// 反向遍历时从前缀之后的第一个键开始，跳过恰好等于该键的记录
+	// badger 的 Valid 会按 opts.Prefix 过滤，因此只在正向遍历时设置前缀
+	seek := prefix
+	if reverse {
+		seek = prefixEnd(prefix)
+	} else {
+		opts.Prefix = prefix
+	}
+
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(seek); it.Valid(); it.Next() {
+		item := it.Item()
+		if !bytes.HasPrefix(item.Key(), prefix) {
+			if reverse && seek != nil && bytes.Equal(item.Key(), seek) {
+				continue
+			}
+			break
+		}
+		err := item.Value(func(val []byte) error {
+			return fn(item.Key(), val)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prefixEnd 返回大于所有以 prefix 开头的键的最小键，不存在时返回 nil
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// badgerBatch 将 badger 批量写入适配为 Batch
+type badgerBatch struct {
+	wb *badger.WriteBatch
+}
+
+// Put 复制键和值后写入，WriteBatch 在提交之前会一直引用传入的切片
+func (b badgerBatch) Put(key, value []byte) error {
+	return b.wb.Set(append([]byte{}, key...), append([]byte{}, value...))
+}
+
+func (b badgerBatch) Delete(key []byte) error {
+	return b.wb.Delete(append([]byte{}, key...))
+}
+
+func (b badgerBatch) Flush() error {
+	return b.wb.Flush()
+}
+
+func (b badgerBatch) Cancel() {
+	b.wb.Cancel()
+}
+
+// retry 函数尝试重新打开数据库，解决 "LOCK" 锁文件导致的数据库无法打开的问题。
+// 它会删除数据库目录中的 "LOCK" 文件，并重试打开数据库。
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK") // 构造 "LOCK" 文件的路径
+
+	// 尝试删除 "LOCK" 文件，可能因为数据库意外关闭留下了该文件
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err) // 如果删除 "LOCK" 文件失败，返回错误
+	}
+
+	retryOpts := originalOpts         // 复制原始的数据库选项
+	db, err := badger.Open(retryOpts) // 尝试重新打开数据库
+	return db, err
+}
+
+// openDB 函数用于打开 Badger 数据库。
+// 如果数据库因为 "LOCK" 锁文件而无法打开，它会尝试删除锁文件并重试打开数据库。
+func openDB(dir string, opts badger.Options) (*badger.DB, error) {
+	// 尝试打开数据库
+	if db, err := badger.Open(opts); err != nil {
+		// 如果错误信息包含 "LOCK"，说明数据库被锁定
+		if strings.Contains(err.Error(), "LOCK") {
+			// 尝试删除锁文件并重新打开数据库
+			if db, err := retry(dir, opts); err == nil {
+				log.Println("database unlocked, value log truncated") // 输出数据库已解锁的信息
+				return db, nil                                        // 成功解锁数据库并打开
+			}
+			log.Println("could not unlock database:", err) // 如果无法解锁，输出错误信息
+		}
+		return nil, err // 如果其他错误，直接返回错误
+	} else {
+		return db, nil // 成功打开数据库，返回数据库实例
+	}
+}
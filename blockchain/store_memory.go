@@ -0,0 +1,176 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// errReadOnlyTxn 表示在只读事务中执行了写操作
+var errReadOnlyTxn = errors.New("write in read-only transaction")
+
+// MemoryStore 是保存在内存中的存储实现，主要用于测试，关闭后数据全部丢失
+// 读写事务之间互斥执行，因此同一时刻最多只有一个读写事务
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewMemoryStore 创建一个空的内存存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+// View 在只读事务中执行 fn
+func (s *MemoryStore) View(fn func(txn Txn) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTxn{store: s})
+}
+
+// Update 在读写事务中执行 fn，fn 返回错误时按相反顺序撤销事务中的写入
+func (s *MemoryStore) Update(fn func(txn Txn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn := &memoryTxn{store: s, writable: true}
+	if err := fn(txn); err != nil {
+		txn.rollback()
+		return err
+	}
+
+	return nil
+}
+
+// NewBatch 创建一个批量写入
+func (s *MemoryStore) NewBatch() Batch {
+	return &memoryBatch{store: s}
+}
+
+// Close 关闭内存存储，内存存储没有需要释放的资源
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// memoryEntry 表示一个键的状态，exists 为 false 表示键不存在
+// 事务用它记录写入之前的状态，批量写入用它记录要执行的操作
+type memoryEntry struct {
+	key    string
+	value  []byte
+	exists bool
+}
+
+// memoryTxn 是内存存储上的事务，写入直接作用于数据并记录撤销信息
+type memoryTxn struct {
+	store    *MemoryStore
+	writable bool
+	undo     []memoryEntry // 写入之前键的状态
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	value, ok := t.store.data[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (t *memoryTxn) Put(key, value []byte) error {
+	if !t.writable {
+		return errReadOnlyTxn
+	}
+	t.record(string(key))
+	t.store.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if !t.writable {
+		return errReadOnlyTxn
+	}
+	t.record(string(key))
+	delete(t.store.data, string(key))
+	return nil
+}
+
+// record 记录键在本次写入之前的状态
+func (t *memoryTxn) record(key string) {
+	value, ok := t.store.data[key]
+	t.undo = append(t.undo, memoryEntry{key, value, ok})
+}
+
+// rollback 撤销事务中的全部写入
+func (t *memoryTxn) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		u := t.undo[i]
+		if u.exists {
+			t.store.data[u.key] = u.value
+		} else {
+			delete(t.store.data, u.key)
+		}
+	}
+	t.undo = nil
+}
+
+// Iterate 遍历开始时对匹配的键排序，遍历期间写入的新键不会被访问，被删除的键会被跳过
+func (t *memoryTxn) Iterate(prefix []byte, reverse bool, fn func(key, value []byte) error) error {
+	var keys []string
+	for key := range t.store.data {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+
+	for _, key := range keys {
+		value, ok := t.store.data[key]
+		if !ok {
+			continue
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// memoryBatch 缓存批量写入的操作，Flush 时一次性写入内存存储
+type memoryBatch struct {
+	store *MemoryStore
+	ops   []memoryEntry
+}
+
+func (b *memoryBatch) Put(key, value []byte) error {
+	b.ops = append(b.ops, memoryEntry{string(key), append([]byte{}, value...), true})
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, memoryEntry{string(key), nil, false})
+	return nil
+}
+
+func (b *memoryBatch) Flush() error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	for _, op := range b.ops {
+		if op.exists {
+			b.store.data[op.key] = op.value
+		} else {
+			delete(b.store.data, op.key)
+		}
+	}
+	b.ops = nil
+	return nil
+}
+
+func (b *memoryBatch) Cancel() {
+	b.ops = nil
+}
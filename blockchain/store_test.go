@@ -0,0 +1,279 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// testStores 返回需要比较行为的所有存储实现
+func testStores(t *testing.T) map[string]Store {
+	badger, err := OpenBadgerStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { badger.Close() })
+
+	return map[string]Store{"badger": badger, "memory": NewMemoryStore()}
+}
+
+// storeKeys 是迭代测试使用的键，包含前缀末尾为 0xff 等边界情况
+var storeKeys = []string{"a", "ab", "abc", "ab\xff", "ab\xff\xff", "abd", "b", "\xff", "\xff\xff"}
+
+func fillStore(t *testing.T, s Store) {
+	err := s.Update(func(txn Txn) error {
+		for _, key := range storeKeys {
+			if err := txn.Put([]byte(key), []byte("v-"+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// iterateKeys 返回 Iterate 访问到的键，同时检查每个键对应的值
+func iterateKeys(t *testing.T, s Store, prefix []byte, reverse bool) []string {
+	var keys []string
+	err := s.View(func(txn Txn) error {
+		return txn.Iterate(prefix, reverse, func(key, value []byte) error {
+			if string(value) != "v-"+string(key) {
+				return fmt.Errorf("key %q has value %q", key, value)
+			}
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestStoreIterate(t *testing.T) {
+	stores := testStores(t)
+	for _, s := range stores {
+		fillStore(t, s)
+	}
+
+	for _, prefix := range []string{"", "a", "ab", "ab\xff", "b", "\xff", "zz"} {
+		for _, reverse := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%q/reverse=%v", prefix, reverse), func(t *testing.T) {
+				var want []string
+				for _, key := range storeKeys {
+					if bytes.HasPrefix([]byte(key), []byte(prefix)) {
+						want = append(want, key)
+					}
+				}
+				sort.Strings(want)
+				if reverse {
+					sort.Sort(sort.Reverse(sort.StringSlice(want)))
+				}
+
+				for name, s := range stores {
+					got := iterateKeys(t, s, []byte(prefix), reverse)
+					if fmt.Sprint(got) != fmt.Sprint(want) {
+						t.Errorf("%s: got %q, want %q", name, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStoreUpdateRollback(t *testing.T) {
+	errAbort := errors.New("abort")
+
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			fillStore(t, s)
+
+			err := s.Update(func(txn Txn) error {
+				if err := txn.Put([]byte("a"), []byte("changed")); err != nil {
+					return err
+				}
+				if err := txn.Put([]byte("new"), []byte("v-new")); err != nil {
+					return err
+				}
+				if err := txn.Delete([]byte("b")); err != nil {
+					return err
+				}
+				// 同一事务中多次修改同一个键
+				if err := txn.Delete([]byte("a")); err != nil {
+					return err
+				}
+
+				// 事务中的读取可以看到之前的写入
+				if _, err := txn.Get([]byte("a")); err != ErrKeyNotFound {
+					return fmt.Errorf("deleted key read: %v", err)
+				}
+				if v, err := txn.Get([]byte("new")); err != nil || string(v) != "v-new" {
+					return fmt.Errorf("written key read: %q, %v", v, err)
+				}
+				return errAbort
+			})
+			if err != errAbort {
+				t.Fatalf("Update = %v, want %v", err, errAbort)
+			}
+
+			// 事务中的修改全部被丢弃
+			got := iterateKeys(t, s, nil, false)
+			want := append([]string{}, storeKeys...)
+			sort.Strings(want)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("after rollback got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreReadOnlyView(t *testing.T) {
+	s := NewMemoryStore()
+	err := s.View(func(txn Txn) error {
+		return txn.Put([]byte("a"), []byte("b"))
+	})
+	if err == nil {
+		t.Fatal("Put in a read-only transaction succeeded")
+	}
+}
+
+// testCoinbase 创建一个支付给不可花费地址的 coinbase 交易
+func testCoinbase(value int, data string) *Transaction {
+	tx := Transaction{nil, []TxInput{{[]byte{}, -1, nil, []byte(data)}}, []TxOutput{{value, unspendablePubKeyHash}}, TxVersion}
+	tx.ID = tx.Hash()
+	return &tx
+}
+
+// mineOn 在 parent 之上挖出一个只包含 coinbase 交易的区块并加入区块链
+func mineOn(t *testing.T, chain *BlockChain, parent []byte, data string) *Block {
+	t.Helper()
+
+	block, err := chain.MineBlockOn(context.Background(), parent, []*Transaction{testCoinbase(chain.Params.Subsidy(1), data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// hasOutput 检查UTXO集合中是否存在交易的第一个输出
+func hasOutput(t *testing.T, chain *BlockChain, txID []byte) bool {
+	t.Helper()
+
+	_, ok, err := UTXOSet{chain}.FindOutput(txID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestMemoryStoreReorg(t *testing.T) {
+	params := RegTestParams
+	chain, err := NewBlockChain(NewMemoryStore(), &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := chain.Tip()
+
+	// 主链：genesis -> a1 -> a2
+	a1 := mineOn(t, chain, genesis, "a1")
+	a2 := mineOn(t, chain, a1.Hash, "a2")
+	if !bytes.Equal(chain.Tip(), a2.Hash) {
+		t.Fatalf("tip = %x, want a2 %x", chain.Tip(), a2.Hash)
+	}
+
+	// 分支：genesis -> b1 -> b2，累计工作量不超过主链时链头不变
+	b1 := mineOn(t, chain, genesis, "b1")
+	b2 := mineOn(t, chain, b1.Hash, "b2")
+	if !bytes.Equal(chain.Tip(), a2.Hash) {
+		t.Fatalf("tip moved to %x on a branch with equal work", chain.Tip())
+	}
+	if !hasOutput(t, chain, a1.Transactions[0].ID) || hasOutput(t, chain, b1.Transactions[0].ID) {
+		t.Fatal("UTXO set changed before reorg")
+	}
+
+	// b3 使分支的累计工作量超过主链，发生链重组
+	b3 := mineOn(t, chain, b2.Hash, "b3")
+	if !bytes.Equal(chain.Tip(), b3.Hash) {
+		t.Fatalf("tip = %x, want b3 %x", chain.Tip(), b3.Hash)
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 3 {
+		t.Fatalf("best height = %d, want 3", height)
+	}
+	for h, want := range [][]byte{genesis, b1.Hash, b2.Hash, b3.Hash} {
+		got, err := chain.GetBlockHashByHeight(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("height %d: hash %x, want %x", h, got, want)
+		}
+	}
+
+	// 旧分支的输出被撤销，新分支的输出加入UTXO集合
+	for _, b := range []*Block{a1, a2} {
+		if hasOutput(t, chain, b.Transactions[0].ID) {
+			t.Fatalf("output of disconnected block %x is still unspent", b.Hash)
+		}
+	}
+	for _, b := range []*Block{b1, b2, b3} {
+		if !hasOutput(t, chain, b.Transactions[0].ID) {
+			t.Fatalf("output of connected block %x is missing", b.Hash)
+		}
+	}
+
+	// 旧分支上的区块仍然保存在数据库中，只是不在主链上
+	if !chain.HasBlock(a2.Hash) {
+		t.Fatal("block a2 was deleted")
+	}
+	for _, b := range []*Block{a2, b2} {
+		onMain, err := chain.IsMainChain(b.Hash, b.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if onMain != (b == b2) {
+			t.Fatalf("IsMainChain(%x) = %v", b.Hash, onMain)
+		}
+	}
+	if _, err := chain.GetBlockHashByHeight(4); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("GetBlockHashByHeight(4) = %v, want %v", err, ErrBlockNotFound)
+	}
+}
+
+func TestReorgTooDeep(t *testing.T) {
+	params := RegTestParams
+	chain, err := NewBlockChain(NewMemoryStore(), &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := chain.Tip()
+
+	tip := genesis
+	for i := 0; i <= MaxReorgDepth; i++ {
+		tip = mineOn(t, chain, tip, fmt.Sprintf("a%d", i)).Hash
+	}
+
+	// 分支的工作量与主链相同时不需要链重组
+	branch := genesis
+	for i := 0; i <= MaxReorgDepth; i++ {
+		branch = mineOn(t, chain, branch, fmt.Sprintf("b%d", i)).Hash
+	}
+
+	// 下一个分支区块需要断开 MaxReorgDepth+1 个主链区块
+	_, err = chain.MineBlockOn(context.Background(), branch, []*Transaction{testCoinbase(params.Subsidy(1), "deep")})
+	if !errors.Is(err, ErrReorgTooDeep) {
+		t.Fatalf("MineBlockOn = %v, want %v", err, ErrReorgTooDeep)
+	}
+	if !bytes.Equal(chain.Tip(), tip) {
+		t.Fatalf("tip moved to %x", chain.Tip())
+	}
+}
@@ -1,50 +1,73 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 
 	"github.com/xuanle1016/golang-blockchain/wallet"
 )
 
+// ErrNotEnoughFunds 表示钱包中可花费的余额不足以支付转账金额和手续费
+var ErrNotEnoughFunds = errors.New("not enough funds")
+
 // Transaction 表示区块链中的一笔交易
 type Transaction struct {
 	ID      []byte     // 交易 ID（哈希值）
 	Inputs  []TxInput  // 交易输入集合
 	Outputs []TxOutput // 交易输出集合
+	Version uint32     // 交易版本，为 0 表示引入规范编码之前的旧交易
 }
 
-// Serialize 将交易序列化为字节数组，用于存储或传输
+// Serialize 将交易按规范编码格式序列化为字节数组，用于存储或传输
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	var e encoder
+	tx.encode(&e)
+
+	return e.Bytes()
+}
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
+// DeserializeTransaction 从规范编码的字节数组反序列化为 Transaction 对象
+// 数据格式错误时返回包装了 ErrBadEncoding 的错误
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	transaction, err := decodeTransaction(data)
 	if err != nil {
-		log.Panic(err)
+		return Transaction{}, err
 	}
 
-	return encoded.Bytes()
+	return *transaction, nil
 }
 
-// DeserializeTransaction 从字节数组反序列化为 Transaction 对象
-func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
+// legacySerialize 使用引入规范编码之前的 gob 格式序列化交易
+// 旧交易的 ID、签名和所在区块的 Merkle 根都基于该格式计算
+func (tx *Transaction) legacySerialize() []byte {
+	return encodeLegacyTransaction(tx)
+}
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	Handle(err)
+// merkleData 返回交易在 Merkle 树中作为叶子的数据
+// 旧交易使用原来的 gob 格式，使旧区块的 Merkle 根保持不变
+// 区块头版本 2 起叶子是交易 ID 加上完整交易的哈希：交易 ID 不包含签名，
+// 附加的哈希保证区块哈希同样覆盖签名
+func (tx *Transaction) merkleData(headerVersion uint32) []byte {
+	if headerVersion >= 2 {
+		hash := sha256.Sum256(tx.Serialize())
+		return append(append([]byte{}, tx.ID...), hash[:]...)
+	}
+	if tx.Version == 0 {
+		return tx.legacySerialize()
+	}
+	return tx.Serialize()
+}
 
-	return transaction
+// MerkleLeaf 返回交易在指定版本区块头的 Merkle 树中的叶子哈希
+func (tx *Transaction) MerkleLeaf(headerVersion uint32) []byte {
+	return merkleHasherFor(headerVersion).leaf(tx.merkleData(headerVersion))
 }
 
 // Hash 生成交易的哈希值（即交易 ID）
@@ -53,30 +76,65 @@ func (tx *Transaction) Hash() []byte {
 
 	txCopy := *tx
 	txCopy.ID = []byte{} // 清空交易 ID
-	hash = sha256.Sum256(txCopy.Serialize())
+	if tx.Version == 0 {
+		hash = sha256.Sum256(txCopy.legacySerialize())
+	} else {
+		hash = sha256.Sum256(txCopy.Serialize())
+	}
 
 	return hash[:]
 }
 
+// UnsignedHash 计算清除所有输入签名后的交易哈希
+// 交易 ID 在签名之前生成，因此验证交易 ID 时需要使用该哈希
+func (tx *Transaction) UnsignedHash() []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = TxInput{in.ID, in.Out, nil, in.PubKey}
+	}
+
+	return txCopy.Hash()
+}
+
 // CoinbaseTx 创建一个 Coinbase 交易（矿工奖励交易，没有输入）
-func CoinbaseTx(to, data string) *Transaction {
+// value 为矿工领取的金额，即区块奖励加上区块中所有交易的手续费
+func CoinbaseTx(to, data string, value int) (*Transaction, error) {
 	// 如果 data 为空，则随机生成数据
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
-		data = fmt.Sprintf("Coins to %s", to)
+		data = fmt.Sprintf("%x", randData) // 随机数据保证每个 coinbase 交易的 ID 唯一
 	}
 
 	txin := TxInput{[]byte{}, -1, nil, []byte(data)} // Coinbase 交易的特殊输入
-	txout := NewTXOutput(100, to)                   // 矿工奖励
+	txout := NewTXOutput(value, to)                 // 矿工奖励
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
+	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}, TxVersion}
 	tx.ID = tx.Hash() // 生成交易 ID
 
-	return &tx
+	return &tx, nil
+}
+
+// Fee 计算交易的手续费，即输入总额减去输出总额
+// prevTXs 需要包含所有输入引用的前置交易
+func (tx *Transaction) Fee(prevTXs map[string]Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+
+	fee := 0
+	for _, in := range tx.Inputs {
+		fee += prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out].Value
+	}
+	for _, out := range tx.Outputs {
+		fee -= out.Value
+	}
+
+	return fee
 }
 
 // IsCoinbase 检查交易是否为 Coinbase 交易
@@ -85,23 +143,29 @@ func (tx *Transaction) IsCoinbase() bool {
 }
 
 // NewTransaction 创建一个新的普通交易
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// 输入总额减去输出总额即为支付给矿工的手续费 fee，可花费余额不足时返回 ErrNotEnoughFunds
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
 	// 计算发起者的公钥哈希值
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	// 找到足够的 UTXO（未花费交易输出）用于支付
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
-	if acc < amount {
-		log.Panic("Error: not enough funds")
+	// 找到足够的 UTXO（未花费交易输出）用于支付金额和手续费
+	acc, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if err != nil {
+		return nil, err
+	}
+	if acc < amount+fee {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrNotEnoughFunds, acc, amount+fee)
 	}
 
 	// 创建输入列表
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-		Handle(err)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, out := range outs {
 			input := TxInput{txID, out, nil, w.PublicKey}
@@ -110,32 +174,35 @@ func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Tra
 	}
 
 	// 创建输出列表
-	from := string(w.Address())
 	outputs = append(outputs, *NewTXOutput(amount, to)) // 发送金额
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // 找零
+	if acc > amount+fee {
+		outputs = append(outputs, TxOutput{acc - amount - fee, pubKeyHash}) // 找零
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, TxVersion}
 	tx.ID = tx.Hash() // 生成交易 ID
 
 	// 签名交易
 	privateKey := wallet.DeserializePrivateKey(w.PrivateKey)
-	UTXO.Blockchain.SignTransaction(&tx, *privateKey)
+	if err := UTXO.Blockchain.SignTransaction(&tx, *privateKey); err != nil {
+		return nil, err
+	}
 
-	return &tx
+	return &tx, nil
 }
 
 // Sign 签名交易
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// prevTXs 缺少任意输入引用的前置交易时返回 ErrMissingInput
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return // Coinbase 交易不需要签名
+		return nil // Coinbase 交易不需要签名
 	}
 
 	// 检查前置交易是否有效
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
 		}
 	}
 
@@ -150,11 +217,15 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		txCopy.Inputs[inId].PubKey = nil
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		Handle(err)
+		if err != nil {
+			return err
+		}
 		signature := append(r.Bytes(), s.Bytes()...)
 
 		tx.Inputs[inId].Signature = signature
 	}
+
+	return nil
 }
 
 // TrimmedCopy 创建交易的精简副本，用于签名和验证
@@ -172,12 +243,13 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.Version}
 
 	return txCopy
 }
 
 // Verify 验证交易签名的合法性
+// prevTXs 缺少输入引用的前置交易或输出时交易视为无效
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true // Coinbase 交易始终有效
@@ -185,8 +257,9 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
 	// 检查前置交易是否有效
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous transaction not correct")
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return false
 		}
 	}
 
@@ -196,6 +269,11 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	// 验证每个输入的签名
 	for inId, in := range tx.Inputs {
 		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+
+		// 输入提供的公钥必须与被花费输出锁定的公钥哈希一致
+		if !in.UsesKey(prevTx.Outputs[in.Out].PubKeyHash) {
+			return false
+		}
 		txCopy.Inputs[inId].Signature = nil
 		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
 		txCopy.ID = txCopy.Hash()
@@ -229,7 +307,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 func (tx Transaction) String() string {
 	var lines []string
 
-	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	lines = append(lines, fmt.Sprintf("--- Transaction %x (version %d):", tx.ID, tx.Version))
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
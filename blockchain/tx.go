@@ -2,7 +2,6 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 
 	"github.com/xuanle1016/golang-blockchain/wallet"
 )
@@ -15,7 +14,24 @@ type TxOutput struct {
 
 // TxOutputs 表示多个交易输出的集合
 type TxOutputs struct {
-	Outputs []TxOutput
+	Outputs  []TxOutput
+	Indexes  []int // 每个输出在原交易中的索引，为空时表示输出按原顺序完整保存
+	Height   int   // 创建这些输出的区块高度
+	Coinbase bool  // 输出是否由 coinbase 交易创建
+}
+
+// SpentOutput 表示被区块花费的一个输出
+type SpentOutput struct {
+	TxID     []byte   // 输出所属的交易 ID
+	Index    int      // 输出在交易中的索引
+	Output   TxOutput // 被花费的输出
+	Height   int      // 创建该输出的区块高度
+	Coinbase bool     // 输出是否由 coinbase 交易创建
+}
+
+// BlockUndo 表示区块的撤销数据，按花费顺序记录区块花费的所有输出
+type BlockUndo struct {
+	Spent []SpentOutput
 }
 
 // TxInput 表示交易的输入
@@ -61,26 +77,67 @@ func NewTXOutput(value int, address string) *TxOutput {
 	return txo
 }
 
-// Serialize 序列化 TxOutputs 结构体为字节数组
+// Index 返回第 i 个输出在原交易中的索引
+func (outs TxOutputs) Index(i int) int {
+	if outs.Indexes == nil {
+		return i
+	}
+	return outs.Indexes[i]
+}
+
+// IsMature 检查这些输出能否被高度为 spendHeight 的区块花费
+// coinbase 交易的输出需要经过 maturity 个区块后才能花费，
+// 创世区块不会被重组，其输出不受该限制
+func (outs TxOutputs) IsMature(spendHeight, maturity int) bool {
+	return !outs.Coinbase || outs.Height == 0 || spendHeight-outs.Height >= maturity
+}
+
+// Insert 按照原交易中的索引顺序插入一个输出
+func (outs *TxOutputs) Insert(index int, out TxOutput) {
+	indexes := make([]int, 0, len(outs.Outputs)+1)
+	outputs := make([]TxOutput, 0, len(outs.Outputs)+1)
+	inserted := false
+
+	for i, o := range outs.Outputs {
+		if !inserted && outs.Index(i) > index {
+			indexes = append(indexes, index)
+			outputs = append(outputs, out)
+			inserted = true
+		}
+		indexes = append(indexes, outs.Index(i))
+		outputs = append(outputs, o)
+	}
+	if !inserted {
+		indexes = append(indexes, index)
+		outputs = append(outputs, out)
+	}
+
+	outs.Outputs = outputs
+	outs.Indexes = indexes
+}
+
+// Serialize 按规范编码格式序列化 TxOutputs 结构体为字节数组
 func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	// 创建编码器
-	encode := gob.NewEncoder(&buffer)
-	// 将结构体编码到 buffer
-	err := encode.Encode(outs)
-	Handle(err)
-
-	return buffer.Bytes()
-}
-
-// DeserializeOutputs 反序列化字节数组为 TxOutputs 结构体
-func DeserializeOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
-	// 创建解码器
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	// 将字节数组解码为结构体
-	err := decode.Decode(&outputs)
-	Handle(err)
-
-	return outputs
+	var e encoder
+	outs.encode(&e)
+
+	return e.Bytes()
+}
+
+// DeserializeOutputs 反序列化规范编码的字节数组为 TxOutputs 结构体
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
+	return decodeOutputs(data)
+}
+
+// Serialize 按规范编码格式序列化 BlockUndo 结构体为字节数组
+func (undo BlockUndo) Serialize() []byte {
+	var e encoder
+	undo.encode(&e)
+
+	return e.Bytes()
+}
+
+// DeserializeUndo 反序列化规范编码的字节数组为 BlockUndo 结构体
+func DeserializeUndo(data []byte) (BlockUndo, error) {
+	return decodeUndo(data)
 }
@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrBadMerkleProof 表示交易包含证明无效
+var ErrBadMerkleProof = errors.New("merkle proof does not match block header")
+
+// TxProof 证明一笔交易包含在某个区块中
+// 验证时只需要区块头，轻节点不必下载完整区块
+type TxProof struct {
+	BlockHash   []byte      // 包含该交易的区块哈希
+	Header      BlockHeader // 区块头
+	Transaction Transaction // 被证明的交易
+	Proof       MerkleProof // 交易在区块 Merkle 树中的包含证明
+}
+
+// GetTxProof 为主链上的交易生成包含证明
+func (chain *BlockChain) GetTxProof(txID []byte) (*TxProof, error) {
+	block, index, err := chain.findTransactionBlock(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := block.MerkleTree().Proof(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxProof{block.Hash, block.BlockHeader, *block.Transactions[index], *proof}, nil
+}
+
+// findTransactionBlock 查找主链上包含指定交易的区块以及交易在区块中的位置
+// 启用交易索引时直接读取索引，否则从链头向前遍历
+func (chain *BlockChain) findTransactionBlock(txID []byte) (*Block, int, error) {
+	var block *Block
+	index := -1
+	indexed := false
+
+	err := chain.Database.View(func(txn Txn) error {
+		enabled, err := indexEnabled(txn, txIndexKey)
+		if err != nil || !enabled {
+			return err
+		}
+		indexed = true
+
+		v, err := txn.Get(txKey(txID))
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		location, err := DeserializeTxLocation(v)
+		if err != nil {
+			return err
+		}
+		if block, err = getBlock(txn, location.BlockHash); err != nil {
+			return err
+		}
+		index = location.Index
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if indexed {
+		if block == nil || index >= len(block.Transactions) {
+			return nil, 0, ErrTxNotFound
+		}
+		return block, index, nil
+	}
+
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, txID) {
+				return block, i, nil
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return nil, 0, ErrTxNotFound
+}
+
+// Verify 检查区块头的工作量证明，以及交易是否包含在区块头记录的 Merkle 根中
+// 调用者还需要确认区块位于自己认可的链上
+func (p *TxProof) Verify() error {
+	if err := p.Header.CheckProofOfWork(p.BlockHash); err != nil {
+		return err
+	}
+	if !bytes.Equal(p.Proof.Leaf, p.Transaction.MerkleLeaf(p.Header.Version)) {
+		return ErrBadMerkleProof
+	}
+	if !VerifyMerkleProof(p.Header.Version, p.Header.MerkleRoot, &p.Proof) {
+		return ErrBadMerkleProof
+	}
+
+	return nil
+}
+
+// Serialize 将交易包含证明按规范编码格式序列化为字节数组
+func (p *TxProof) Serialize() []byte {
+	var e encoder
+	p.encode(&e)
+
+	return e.Bytes()
+}
+
+// DeserializeTxProof 将规范编码的字节数组反序列化为交易包含证明
+func DeserializeTxProof(data []byte) (*TxProof, error) {
+	var p TxProof
+	d := &decoder{data: data}
+	p.decode(d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
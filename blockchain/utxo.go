@@ -3,230 +3,291 @@ package blockchain
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-
-	"github.com/dgraph-io/badger/v3"
 )
 
 var (
 	utxoPrefix   = []byte("utxo-") // UTXO数据的前缀
 	prefixLength = len(utxoPrefix) // 前缀的长度
+	undoPrefix   = []byte("undo-") // 区块撤销数据的前缀
 )
 
+// ErrMissingUndoData 表示区块没有撤销数据（例如在引入撤销数据之前连接的区块），
+// 这样的区块无法从UTXO集合中断开，需要断开它的链重组会被拒绝
+var ErrMissingUndoData = errors.New("block undo data is missing")
+
 // UTXOSet 结构体表示一个UTXO集合，它与区块链相关联
 type UTXOSet struct {
 	Blockchain *BlockChain // 区块链
 }
 
 // FindSpendableOutputs 查找可花费的输出（UTXO）
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// 尚未成熟的 coinbase 输出不能被下一个区块花费，因此会被跳过
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
 	fmt.Printf("Finding spendable outputs for: %x\n", pubKeyHash)
 	unspentOuts := make(map[string][]int) // 存储可用的UTXO
 	accumulated := 0 // 累积的金额
 	db := u.Blockchain.Database // 获取数据库实例
+	bestHeight, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return 0, nil, err
+	}
+	spendHeight := bestHeight + 1
 
-	// 使用Badger数据库的视图事务
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions // 默认迭代器选项
-
-		it := txn.NewIterator(opts) // 创建一个迭代器
-		defer it.Close()
-
+	// 使用数据库的视图事务
+	err = db.View(func(txn Txn) error {
 		// 遍历所有UTXO条目
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var v []byte
-			// 获取UTXO值
-			err := item.Value(func(val []byte) error {
-				fmt.Printf("Checking UTXO key: %x\n", k)
-				v = val
-				return nil
-			})
-			Handle(err)
+		return txn.Iterate(utxoPrefix, false, func(k, v []byte) error {
+			fmt.Printf("Checking UTXO key: %x\n", k)
 			k = bytes.TrimPrefix(k, utxoPrefix) // 去掉前缀
 			txID := hex.EncodeToString(k) // 获取交易ID
-			outs := DeserializeOutputs(v) // 反序列化输出
+			outs, err := DeserializeOutputs(v) // 反序列化输出
+			if err != nil {
+				return err
+			}
+			if !outs.IsMature(spendHeight, u.Blockchain.Params.CoinbaseMaturity) {
+				return nil
+			}
 
 			// 遍历每个输出并判断是否满足条件
 			for outIdx, out := range outs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+					unspentOuts[txID] = append(unspentOuts[txID], outs.Index(outIdx))
 				}
 			}
-		}
-		return nil
+			return nil
+		})
 	})
-	Handle(err)
+	if err != nil {
+		return 0, nil, err
+	}
 
 	fmt.Printf("Accumulated: %d, UnspentOuts: %+v\n", accumulated, unspentOuts)
-	return accumulated, unspentOuts
+	return accumulated, unspentOuts, nil
 }
 
 // Reindex 重新索引UTXO集合
-func (u UTXOSet) Reindex() {
+func (u UTXOSet) Reindex() error {
 	fmt.Println("Reindexing UTXO set...")
 	db := u.Blockchain.Database
 
 	// 删除旧的UTXO数据
-	u.DeleteByPrefix(utxoPrefix)
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
 
 	// 查找区块链中的UTXO
-	UTXO := u.Blockchain.FindUTXO()
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Found UTXOs: %+v\n", UTXO)
 
 	// 将UTXO数据重新保存到数据库
-	err := db.Update(func(txn *badger.Txn) error {
+	err = db.Update(func(txn Txn) error {
 		for txId, outs := range UTXO {
 			key, err := hex.DecodeString(txId) // 解码交易ID
-			Handle(err)
-			key = append(utxoPrefix, key...) // 加上前缀
+			if err != nil {
+				return err
+			}
+			key = append(append([]byte{}, utxoPrefix...), key...) // 加上前缀
 			fmt.Printf("Adding UTXO for txId: %s\n", txId)
-			err = txn.Set(key, outs.Serialize()) // 保存UTXO
-			Handle(err)
+			if err := txn.Put(key, outs.Serialize()); err != nil { // 保存UTXO
+				return err
+			}
 		}
 
 		return nil
 	})
-	Handle(err)
+	if err != nil {
+		return err
+	}
 	fmt.Println("UTXO set reindexed")
+	return nil
 }
 
 // DeleteByPrefix 根据前缀删除数据
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
-	// 定义删除数据的方法
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
-		return nil
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
+	// 遍历所有数据并通过批量写入删除，遍历结束后再统一提交
+	batch := u.Blockchain.Database.NewBatch()
+	defer batch.Cancel()
+
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		return txn.Iterate(prefix, false, func(key, _ []byte) error {
+			return batch.Delete(key)
+		})
+	})
+	if err != nil {
+		return err
 	}
 
-	collectSize := 100000 // 每次删除的键的数量
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		// 遍历所有数据并准备删除
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				// 批量删除
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
-		}
-		// 删除剩余的键
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
-			}
-		}
-		return nil
-	})
+	return batch.Flush()
 }
 
 // Update 更新UTXO集合（每次区块添加时调用）
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+// 被花费的输出会作为撤销数据保存，以便之后通过 Revert 断开该区块
+func (u *UTXOSet) Update(block *Block) error {
+	return u.Blockchain.Database.Update(func(txn Txn) error {
+		return u.connect(txn, block)
+	})
+}
 
-	// 更新UTXO集合
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() { // 排除coinbase交易
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...) // 输入的UTXO ID
-					item, err := txn.Get(inID)
-					Handle(err)
-					var v []byte
-					// 获取UTXO值
-					err = item.Value(func(val []byte) error {
-						v = val
-						return nil
-					})
-					Handle(err)
-
-					outs := DeserializeOutputs(v) // 反序列化输出
-
-					// 更新UTXO（如果输入没有被花费）
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
+// Revert 撤销区块对UTXO集合的修改（断开区块时调用），是 Update 的逆操作
+// 区块产生的输出被删除，区块花费的输出根据撤销数据恢复
+func (u *UTXOSet) Revert(block *Block) error {
+	return u.Blockchain.Database.Update(func(txn Txn) error {
+		return u.disconnect(txn, block)
+	})
+}
+
+// connect 在事务中将区块应用到UTXO集合，并保存区块的撤销数据
+func (u *UTXOSet) connect(txn Txn, block *Block) error {
+	undo := BlockUndo{}
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() { // 排除coinbase交易
+			for _, in := range tx.Inputs {
+				inID := append(append([]byte{}, utxoPrefix...), in.ID...) // 输入的UTXO ID
+				v, err := txn.Get(inID)
+				if err == ErrKeyNotFound {
+					return ruleError(block, ErrMissingInput, "%x:%d", in.ID, in.Out)
+				}
+				if err != nil {
+					return err
+				}
+
+				outs, err := DeserializeOutputs(v) // 反序列化输出
+				if err != nil {
+					return err
+				}
+				if !outs.IsMature(block.Height, u.Blockchain.Params.CoinbaseMaturity) {
+					return ruleError(block, ErrImmatureSpend, "%x:%d created at height %d", in.ID, in.Out, outs.Height)
+				}
+
+				// 从UTXO中移除被花费的输出，并记录到撤销数据中
+				updatedOuts := TxOutputs{Height: outs.Height, Coinbase: outs.Coinbase}
+				spent := false
+				for i, out := range outs.Outputs {
+					if outs.Index(i) == in.Out {
+						undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, out, outs.Height, outs.Coinbase})
+						spent = true
+						continue
 					}
+					updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+					updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(i))
+				}
+				if !spent {
+					return ruleError(block, ErrMissingInput, "%x:%d", in.ID, in.Out)
+				}
 
-					// 如果输出为空，则删除该UTXO
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
+				// 如果输出为空，则删除该UTXO
+				if len(updatedOuts.Outputs) == 0 {
+					if err := txn.Delete(inID); err != nil {
+						return err
+					}
+				} else {
+					if err := txn.Put(inID, updatedOuts.Serialize()); err != nil {
+						return err
 					}
 				}
 			}
+		}
+
+		// 新的交易输出
+		newOutputs := TxOutputs{
+			Outputs:  append([]TxOutput{}, tx.Outputs...),
+			Height:   block.Height,
+			Coinbase: tx.IsCoinbase(),
+		}
+
+		// 将新交易的输出存入数据库
+		txID := append(append([]byte{}, utxoPrefix...), tx.ID...)
+		if err := txn.Put(txID, newOutputs.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return txn.Put(undoKey(block.Hash), undo.Serialize())
+}
+
+// disconnect 在事务中撤销区块对UTXO集合的修改，并删除区块的撤销数据
+func (u *UTXOSet) disconnect(txn Txn, block *Block) error {
+	v, err := txn.Get(undoKey(block.Hash))
+	if err == ErrKeyNotFound {
+		return ErrMissingUndoData
+	}
+	if err != nil {
+		return err
+	}
+	undo, err := DeserializeUndo(v)
+	if err != nil {
+		return err
+	}
+
+	// 按照与连接时相反的顺序处理交易和输入
+	for t := len(block.Transactions) - 1; t >= 0; t-- {
+		tx := block.Transactions[t]
+
+		// 删除该交易产生的输出
+		txID := append(append([]byte{}, utxoPrefix...), tx.ID...)
+		if err := txn.Delete(txID); err != nil {
+			return err
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
 
-			// 新的交易输出
-			newOutputs := TxOutputs{
-				Outputs: append([]TxOutput{}, tx.Outputs...),
+		// 恢复该交易花费的输出
+		for i := len(tx.Inputs) - 1; i >= 0; i-- {
+			if len(undo.Spent) == 0 {
+				return fmt.Errorf("undo data of block %x is incomplete", block.Hash)
+			}
+			spent := undo.Spent[len(undo.Spent)-1]
+			undo.Spent = undo.Spent[:len(undo.Spent)-1]
+
+			inID := append(append([]byte{}, utxoPrefix...), spent.TxID...)
+			outs := TxOutputs{Height: spent.Height, Coinbase: spent.Coinbase}
+			v, err := txn.Get(inID)
+			if err == nil {
+				if outs, err = DeserializeOutputs(v); err != nil {
+					return err
+				}
+			} else if err != ErrKeyNotFound {
+				return err
 			}
 
-			// 将新交易的输出存入数据库
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+			outs.Insert(spent.Index, spent.Output)
+			if err := txn.Put(inID, outs.Serialize()); err != nil {
+				return err
 			}
 		}
+	}
 
-		return nil
-	})
-	Handle(err)
+	return txn.Delete(undoKey(block.Hash))
+}
+
+// undoKey 返回保存区块撤销数据的键
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
 }
 
 // FindUnspentTransactions 查找所有未花费的交易输出
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
 
 	db := u.Blockchain.Database
 
 	// 使用数据库视图事务查找所有UTXO
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
+	err := db.View(func(txn Txn) error {
 		// 遍历所有UTXO并筛选出符合条件的
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			var v []byte
-			err := item.Value(func(val []byte) error {
-				v = val
-				return nil
-			})
-			Handle(err)
-			outs := DeserializeOutputs(v)
+		return txn.Iterate(utxoPrefix, false, func(_, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
 
 			// 筛选与给定公钥哈希匹配的输出
 			for _, out := range outs.Outputs {
@@ -234,34 +295,159 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 					UTXOs = append(UTXOs, out)
 				}
 			}
-		}
-
-		return nil
+			return nil
+		})
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
-	return UTXOs
+	return UTXOs, nil
 }
 
 // CountTransactions 计算数据库中存储的交易数量
-func (u UTXOSet) CountTransactions() int {
+func (u UTXOSet) CountTransactions() (int, error) {
 	db := u.Blockchain.Database
 	counter := 0
 
 	// 使用数据库视图事务统计交易数量
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+	err := db.View(func(txn Txn) error {
+		return txn.Iterate(utxoPrefix, false, func(_, _ []byte) error {
 			counter++
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return counter, nil
+}
+
+// FindOutput 在UTXO集合中查找指定交易的指定输出，输出不存在或已被花费时返回 false
+func (u UTXOSet) FindOutput(txID []byte, index int) (TxOutput, bool, error) {
+	outs, ok, err := u.findOutputs(txID)
+	if err != nil || !ok {
+		return TxOutput{}, false, err
+	}
+
+	for i, out := range outs.Outputs {
+		if outs.Index(i) == index {
+			return out, true, nil
+		}
+	}
+
+	return TxOutput{}, false, nil
+}
+
+// findOutputs 读取指定交易在UTXO集合中尚未花费的全部输出
+func (u UTXOSet) findOutputs(txID []byte) (TxOutputs, bool, error) {
+	var outs TxOutputs
+	found := false
+
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		v, err := txn.Get(append(append([]byte{}, utxoPrefix...), txID...))
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 
+		outs, err = DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		found = true
 		return nil
 	})
+	if err != nil {
+		return TxOutputs{}, false, err
+	}
+
+	return outs, found, nil
+}
+
+// TransactionFee 根据UTXO集合计算交易的手续费
+// 任意输入不存在或已被花费时返回 ErrMissingInput
+func (u UTXOSet) TransactionFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	fee := 0
+	for _, in := range tx.Inputs {
+		out, ok, err := u.FindOutput(in.ID, in.Out)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
+		}
+		fee += out.Value
+	}
+	for _, out := range tx.Outputs {
+		fee -= out.Value
+	}
+
+	return fee, nil
+}
+
+// TotalSupply 计算UTXO集合中所有输出的金额总和，即当前流通的货币总量
+func (u UTXOSet) TotalSupply() (int, error) {
+	supply := 0
+
+	err := u.Blockchain.Database.View(func(txn Txn) error {
+		return txn.Iterate(utxoPrefix, false, func(_, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+			for _, out := range outs.Outputs {
+				supply += out.Value
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return supply, nil
+}
+
+// Balance 计算指定公钥哈希的余额
+// 返回可以在下一个区块中花费的余额，以及尚未成熟的 coinbase 输出的金额
+func (u UTXOSet) Balance(pubKeyHash []byte) (int, int, error) {
+	mature, immature := 0, 0
+	bestHeight, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+	spendHeight := bestHeight + 1
 
-	Handle(err)
+	err = u.Blockchain.Database.View(func(txn Txn) error {
+		return txn.Iterate(utxoPrefix, false, func(_, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+			for _, out := range outs.Outputs {
+				if !out.IsLockedWithKey(pubKeyHash) {
+					continue
+				}
+				if outs.IsMature(spendHeight, u.Blockchain.Params.CoinbaseMaturity) {
+					mature += out.Value
+				} else {
+					immature += out.Value
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
 
-	return counter
+	return mature, immature, nil
 }
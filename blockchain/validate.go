@@ -0,0 +1,206 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 区块违反的共识规则，通过 errors.Is 判断 RuleError 的具体原因
+var (
+	ErrNoTransactions   = errors.New("block contains no transactions")
+	ErrBadProofOfWork   = errors.New("block hash does not satisfy proof of work")
+	ErrBadBlockHash     = errors.New("block hash does not match block header")
+	ErrBadVersion       = errors.New("block header version is not supported")
+	ErrBadMerkleRoot    = errors.New("merkle root does not match block transactions")
+	ErrOrphanBlock      = errors.New("previous block is unknown")
+	ErrBadHeight        = errors.New("block height is not previous height + 1")
+	ErrBadDifficulty    = errors.New("block difficulty does not match the required target")
+	ErrBadTimestamp     = errors.New("block timestamp is out of range")
+	ErrBadCoinbase      = errors.New("block must contain exactly one coinbase transaction")
+	ErrBadCoinbaseValue = errors.New("coinbase pays more than allowed")
+	ErrBadTxID          = errors.New("transaction ID does not match its contents")
+	ErrBadTransaction   = errors.New("transaction is malformed")
+	ErrBadSignature     = errors.New("transaction signature is invalid")
+	ErrDuplicateTx      = errors.New("transaction appears more than once")
+	ErrDoubleSpend      = errors.New("output is spent more than once in block")
+	ErrMissingInput     = errors.New("transaction input does not exist or is already spent")
+	ErrImmatureSpend    = errors.New("transaction spends an immature coinbase output")
+	ErrBadValue         = errors.New("transaction outputs exceed inputs")
+)
+
+// RuleError 表示区块因违反共识规则而被拒绝
+type RuleError struct {
+	Hash   []byte // 被拒绝区块的哈希
+	Err    error  // 违反的规则
+	Detail string // 补充说明
+}
+
+func (e *RuleError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("block %x rejected: %v", e.Hash, e.Err)
+	}
+	return fmt.Sprintf("block %x rejected: %v: %s", e.Hash, e.Err, e.Detail)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// ruleError 创建一个 RuleError
+func ruleError(block *Block, err error, format string, args ...interface{}) error {
+	return &RuleError{block.Hash, err, fmt.Sprintf(format, args...)}
+}
+
+// ValidateBlock 检查区块是否满足全部共识规则，在区块保存或改变链头之前调用
+// 输入是否未被花费依赖于区块所在分支的UTXO集合，由连接区块时检查
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return ruleError(block, ErrNoTransactions, "")
+	}
+
+	if block.Version > HeaderVersion {
+		return ruleError(block, ErrBadVersion, "version %d", block.Version)
+	}
+
+	// 检查工作量证明以及区块哈希是否与区块头一致，再检查区块头中的 Merkle 根是否与区块中的交易一致
+	if err := block.CheckProofOfWork(block.Hash); err != nil {
+		return ruleError(block, err, "")
+	}
+	// 补齐奇数层会让重复末尾交易的区块得到相同的 Merkle 根，这类区块由 validateTransactions 中的 ErrDuplicateTx 拒绝
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return ruleError(block, ErrBadMerkleRoot, "")
+	}
+
+	// 父区块必须已知，且高度连续
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return ruleError(block, ErrOrphanBlock, "%x", block.PrevHash)
+	}
+	if block.Height != parent.Height+1 {
+		return ruleError(block, ErrBadHeight, "height %d, previous height %d", block.Height, parent.Height)
+	}
+
+	// 难度目标必须与链在该高度要求的目标一致
+	bits, err := chain.NextBits(&parent)
+	if err != nil {
+		return err
+	}
+	if block.Bits != bits {
+		return ruleError(block, ErrBadDifficulty, "bits %08x, required %08x", block.Bits, bits)
+	}
+
+	// 时间戳不能早于之前区块的中位时间，也不能超出当前时间太多
+	medianTime, err := chain.MedianTimePast(&parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp < medianTime {
+		return ruleError(block, ErrBadTimestamp, "timestamp %d is before median time %d", block.Timestamp, medianTime)
+	}
+	if block.Timestamp > time.Now().Unix()+MaxFutureTime {
+		return ruleError(block, ErrBadTimestamp, "timestamp %d is too far in the future", block.Timestamp)
+	}
+
+	return chain.validateTransactions(block)
+}
+
+// validateTransactions 检查区块中交易的格式、签名和金额
+func (chain *BlockChain) validateTransactions(block *Block) error {
+	var coinbase *Transaction
+	blockTXs := make(map[string]Transaction)
+	spent := make(map[string]bool)
+
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, tx.UnsignedHash()) {
+			return ruleError(block, ErrBadTxID, "%x", tx.ID)
+		}
+
+		txID := hex.EncodeToString(tx.ID)
+		if _, ok := blockTXs[txID]; ok {
+			return ruleError(block, ErrDuplicateTx, "%x", tx.ID)
+		}
+		blockTXs[txID] = *tx
+
+		if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+			return ruleError(block, ErrBadTransaction, "%x has no inputs or outputs", tx.ID)
+		}
+		for _, out := range tx.Outputs {
+			if out.Value < 0 {
+				return ruleError(block, ErrBadTransaction, "%x has a negative output", tx.ID)
+			}
+		}
+
+		if tx.IsCoinbase() {
+			if coinbase != nil {
+				return ruleError(block, ErrBadCoinbase, "")
+			}
+			coinbase = tx
+			continue
+		}
+
+		// 同一区块内不能重复花费同一个输出
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+			if spent[outpoint] {
+				return ruleError(block, ErrDoubleSpend, "%s", outpoint)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	if coinbase == nil {
+		return ruleError(block, ErrBadCoinbase, "")
+	}
+
+	fees := 0
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		// 前置交易可能位于区块所在分支上，也可能位于同一区块中
+		prevTXs := make(map[string]Transaction)
+		inputValue := 0
+		for _, in := range tx.Inputs {
+			inID := hex.EncodeToString(in.ID)
+			prevTX, ok := blockTXs[inID]
+			if !ok {
+				found, err := chain.findTransactionFrom(block.PrevHash, in.ID)
+				if err != nil {
+					return ruleError(block, ErrMissingInput, "%x:%d", in.ID, in.Out)
+				}
+				prevTX = found
+			}
+			if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+				return ruleError(block, ErrMissingInput, "%x:%d", in.ID, in.Out)
+			}
+			prevTXs[inID] = prevTX
+			inputValue += prevTX.Outputs[in.Out].Value
+		}
+
+		if !tx.Verify(prevTXs) {
+			return ruleError(block, ErrBadSignature, "%x", tx.ID)
+		}
+
+		fee := tx.Fee(prevTXs)
+		if fee < 0 {
+			return ruleError(block, ErrBadValue, "%x: inputs %d, outputs %d", tx.ID, inputValue, inputValue-fee)
+		}
+		fees += fee
+	}
+
+	// coinbase 最多只能领取该高度的区块奖励和区块中所有交易的手续费
+	coinbaseValue := 0
+	for _, out := range coinbase.Outputs {
+		coinbaseValue += out.Value
+	}
+	allowed := chain.Params.Subsidy(block.Height) + fees
+	if coinbaseValue > allowed {
+		return ruleError(block, ErrBadCoinbaseValue, "pays %d, allowed %d", coinbaseValue, allowed)
+	}
+
+	return nil
+}
@@ -1,12 +1,19 @@
 package cli
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/xuanle1016/golang-blockchain/blockchain"
 	"github.com/xuanle1016/golang-blockchain/network"
@@ -14,19 +21,152 @@ import (
 )
 
 // CommandLine 结构体，表示命令行接口
-type CommandLine struct{}
+type CommandLine struct {
+	dataDir string                  // 当前网络的数据目录
+	params  *blockchain.ChainParams // 当前网络的参数
+}
 
 // 打印可用命令的用法
 func (cli *CommandLine) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println(" getbalance -address ADDRESS - 获取某地址的余额")
-	fmt.Println(" createblockchain -address ADDRESS 创建区块链，并将创世奖励发送到指定地址")
+	fmt.Println(" createblockchain - 使用网络的创世区块创建区块链，其它命令在区块链不存在时也会自动创建")
 	fmt.Println(" printchain - 打印区块链中的所有区块")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - 发送一定金额的币。如果设置-mine标志，将在本地立即挖矿")
+	fmt.Println(" getblock -height HEIGHT | -hash HASH - 按高度或哈希打印主链上的区块")
+	fmt.Println(" getmerkleproof -txid TXID -node HOST:PORT - 生成并验证主链上交易的 Merkle 包含证明。设置 -node 时向该全节点请求证明，并检查区块是否在本地主链上")
+	fmt.Println(" generate -n N -address ADDRESS - 立即挖出 N 个只包含 coinbase 交易的区块，奖励发送到指定地址，主要用于 regtest 网络")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -mine -node HOST:PORT - 发送一定金额的币并支付手续费。如果设置-mine标志，将在本地立即挖矿，否则将交易提交给 -node 指定的节点，默认为本机上网络的默认端口")
 	fmt.Println(" createwallet - 创建一个新的钱包")
 	fmt.Println(" listaddresses - 列出钱包文件中的所有地址")
 	fmt.Println(" reindexutxo - 重建UTXO集合")
-	fmt.Println(" startnode -miner ADDRESS - 使用指定的NODE_ID启动一个节点。-miner 启用挖矿功能并设置奖励地址")
+	fmt.Println(" reindex-txindex - 重建并启用交易索引")
+	fmt.Println(" reindex-addrindex - 重建并启用地址索引")
+	fmt.Println(" history -address ADDRESS -offset OFFSET -limit LIMIT - 按从新到旧的顺序分页列出地址的交易记录，需要先启用地址索引")
+	fmt.Println(" getsupply - 根据UTXO集合统计已发行的货币总量")
+	fmt.Println(" startnode -port PORT -miner ADDRESS -seed HOST:PORT,... - 启动一个节点，默认使用网络的默认端口。-miner 启用挖矿功能并设置奖励地址，-seed 设置启动时连接的初始节点，之后通过地址簿连接其它节点")
+	fmt.Println(" addnode -addr HOST:PORT - 将节点手动加入地址簿，节点启动后总是尝试连接该节点")
+	fmt.Println(" removenode -addr HOST:PORT - 从地址簿中删除节点")
+	fmt.Println(" listpeers - 列出地址簿中的节点。节点运行时添加或删除的节点在几秒内生效")
+	fmt.Println()
+	fmt.Println("所有命令都支持以下参数:")
+	fmt.Println(" -datadir DIR - 数据根目录，默认为 " + defaultDataDir())
+	fmt.Println(" -network NAME - 使用的网络: mainnet、testnet 或 regtest，默认为 mainnet，主网以外的网络数据保存在数据根目录的同名子目录中")
+}
+
+// defaultDataDir 返回默认的数据根目录，即用户主目录下的 .golang-blockchain
+// 使用固定目录避免在不同的工作目录中运行时各自创建新的区块链
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".golang-blockchain"
+	}
+	return filepath.Join(home, ".golang-blockchain")
+}
+
+// legacyDir 是旧版本保存数据的目录，位于当前工作目录下，
+// 区块链和钱包分别保存在 blocks_<NODE_ID> 和 wallets_<NODE_ID>.data 中
+const legacyDir = "tmp"
+
+// migrateLegacyData 将旧版本保存在 tmp 目录中的主网数据复制到数据目录
+// 节点 ID 取自旧版本使用的 NODE_ID 环境变量，未设置时为主网的默认端口；
+// 只有数据目录中还没有对应的区块链或钱包时才会复制，旧文件保持不变
+func (cli *CommandLine) migrateLegacyData() {
+	// 旧版本只有主网
+	if cli.params.Name != blockchain.MainNetParams.Name {
+		return
+	}
+
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		nodeID = cli.params.DefaultPort
+	}
+
+	legacy := []struct{ old, new string }{
+		{filepath.Join(legacyDir, "blocks_"+nodeID), blockchain.DBPath(cli.dataDir)},
+		{filepath.Join(legacyDir, "wallets_"+nodeID+".data"), wallet.FilePath(cli.dataDir)},
+	}
+
+	migrated := false
+	for _, l := range legacy {
+		if _, err := os.Stat(l.old); err != nil {
+			continue
+		}
+		if _, err := os.Stat(l.new); err == nil {
+			continue
+		}
+
+		if err := copyPath(l.old, l.new); err != nil {
+			fmt.Printf("无法将旧版本的数据 %s 复制到 %s: %v\n", l.old, l.new, err)
+			runtime.Goexit()
+		}
+		fmt.Printf("已将旧版本的数据 %s 复制到 %s，旧文件保持不变，确认无误后可以删除\n", l.old, l.new)
+		migrated = true
+	}
+	if !migrated {
+		return
+	}
+
+	// 其它节点 ID 的旧数据需要分别复制到各自的数据目录
+	others, _ := filepath.Glob(filepath.Join(legacyDir, "blocks_*"))
+	wallets, _ := filepath.Glob(filepath.Join(legacyDir, "wallets_*.data"))
+	for _, path := range append(others, wallets...) {
+		if path == legacy[0].old || path == legacy[1].old {
+			continue
+		}
+		fmt.Printf("发现其它节点的旧数据 %s，可以设置 NODE_ID 并通过 -datadir 指定新的数据目录来复制\n", path)
+	}
+}
+
+// copyPath 将文件或目录（只包含普通文件）复制到 dst
+// 先复制到临时路径再重命名，复制中断时不会留下不完整的数据
+func copyPath(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(tmp, info.Mode().Perm()); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				return fmt.Errorf("unexpected entry %s", filepath.Join(src, entry.Name()))
+			}
+			if err := copyFile(filepath.Join(src, entry.Name()), filepath.Join(tmp, entry.Name())); err != nil {
+				return err
+			}
+		}
+	} else if err := copyFile(src, tmp); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// copyFile 复制单个文件，保留文件权限
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, info.Mode().Perm())
 }
 
 // 验证命令行参数是否合法
@@ -37,35 +177,169 @@ func (cli *CommandLine) validateArgs() {
 	}
 }
 
-// 启动节点，并可选择启用挖矿功能
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
-	fmt.Printf("Starting node %s\n", nodeID)
+// 打开数据目录中的区块链，区块链不存在时自动创建，无法打开时打印原因并退出
+func (cli *CommandLine) openChain() *blockchain.BlockChain {
+	chain, err := blockchain.ContinueBlockChain(cli.dataDir, cli.params)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	return chain
+}
+
+// 启动节点，并可选择启用挖矿功能，seeds 为启动时连接的初始节点
+func (cli *CommandLine) StartNode(port, minerAddress string, seeds []string) {
+	fmt.Printf("Starting %s node on port %s\n", cli.params.Name, port)
 
 	if len(minerAddress) > 0 {
-		if wallet.ValidateAddress(minerAddress) {
+		if wallet.ValidateAddress(minerAddress, cli.params.AddressVersion) {
 			fmt.Println("挖矿已启用。奖励地址: ", minerAddress)
 		} else {
 			log.Panic("无效的矿工地址!")
 		}
 	}
 
-	network.StartServer(nodeID, minerAddress)
+	for _, seed := range seeds {
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			log.Panic("无效的初始节点地址: ", seed)
+		}
+	}
+
+	network.StartServer(cli.dataDir, cli.params, port, minerAddress, seeds)
+}
+
+// 加载数据目录中的地址簿
+func (cli *CommandLine) loadAddrBook() *network.AddrBook {
+	book, err := network.LoadAddrBook(cli.dataDir)
+	if err != nil {
+		log.Panic(err)
+	}
+	return book
+}
+
+// 将节点手动加入地址簿
+func (cli *CommandLine) addNode(addr string) {
+	book := cli.loadAddrBook()
+	if err := book.AddManual(addr); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := book.Save(); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println("已添加节点:", addr)
+}
+
+// 从地址簿中删除节点
+func (cli *CommandLine) removeNode(addr string) {
+	book := cli.loadAddrBook()
+	if !book.Remove(addr) {
+		fmt.Println("地址簿中没有该节点:", addr)
+		return
+	}
+	if err := book.Save(); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println("已删除节点:", addr)
+}
+
+// 列出地址簿中的节点，按最近在线的时间从新到旧排列
+func (cli *CommandLine) listPeers() {
+	addrs := cli.loadAddrBook().Addresses()
+	if len(addrs) == 0 {
+		fmt.Println("地址簿为空")
+		return
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "从未"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	}
+
+	for _, ka := range addrs {
+		manual := ""
+		if ka.Manual {
+			manual = "  手动添加"
+		}
+		fmt.Printf("%s  最近在线: %s  最近连接成功: %s  连续失败: %d%s\n",
+			ka.Addr, formatTime(ka.LastSeen), formatTime(ka.LastSuccess), ka.Attempts, manual)
+	}
 }
 
 // 重建UTXO集合
-func (cli *CommandLine) reindexUTXO(nodeID string) {
-	chain := blockchain.ContinueBlockChain(nodeID)
+func (cli *CommandLine) reindexUTXO() {
+	chain := cli.openChain()
 	defer chain.Database.Close()
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-	UTXOSet.Reindex()
+	if err := UTXOSet.Reindex(); err != nil {
+		log.Panic(err)
+	}
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
 	fmt.Printf("完成! 当前UTXO集合包含 %d 笔交易.\n", count)
 }
 
+// 重建交易索引，重建后区块连接和断开时会自动维护该索引
+func (cli *CommandLine) reindexTxIndex() {
+	chain := cli.openChain()
+	defer chain.Database.Close()
+
+	count, err := chain.ReindexTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("完成! 交易索引包含 %d 笔交易.\n", count)
+}
+
+// 重建地址索引，重建后区块连接和断开时会自动维护该索引
+func (cli *CommandLine) reindexAddrIndex() {
+	chain := cli.openChain()
+	defer chain.Database.Close()
+
+	count, err := chain.ReindexAddresses()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("完成! 地址索引包含 %d 条记录.\n", count)
+}
+
+// 分页打印地址的交易记录
+func (cli *CommandLine) history(address string, offset, limit int) {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
+		log.Panic("地址无效")
+	}
+
+	chain := cli.openChain()
+	defer chain.Database.Close()
+
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+
+	history, total, err := chain.AddressHistory(pubKeyHash, offset, limit)
+	if err == blockchain.ErrAddrIndexDisabled {
+		fmt.Println("地址索引未启用，请先运行 reindex-addrindex")
+		return
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("地址 %s 共有 %d 笔交易，显示第 %d 到 %d 笔:\n", address, total, offset+1, offset+len(history))
+	for _, atx := range history {
+		fmt.Printf("高度 %d  交易 %x  %-3s  %d\n", atx.Height, atx.TxID, atx.Direction(), atx.Amount())
+	}
+}
+
 // 列出钱包文件中的所有地址
-func (cli *CommandLine) listAddresses(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
+func (cli *CommandLine) listAddresses() {
+	wallets, _ := wallet.CreateWallets(cli.dataDir)
 	addresses := wallets.GetAllAddress()
 
 	for _, address := range addresses {
@@ -74,33 +348,27 @@ func (cli *CommandLine) listAddresses(nodeID string) {
 }
 
 // 创建新的钱包地址
-func (cli *CommandLine) createWallet(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
-	address := wallets.AddWallet()
-	wallets.SaveFile(nodeID)
+func (cli *CommandLine) createWallet() {
+	wallets, _ := wallet.CreateWallets(cli.dataDir)
+	address := wallets.AddWallet(cli.params.AddressVersion)
+	wallets.SaveFile(cli.dataDir)
 
 	fmt.Printf("新的地址: %s\n", address)
 }
 
 // 打印区块链中所有区块信息
-func (cli *CommandLine) printChain(nodeID string) {
-	chain := blockchain.ContinueBlockChain(nodeID)
+func (cli *CommandLine) printChain() {
+	chain := cli.openChain()
 	defer chain.Database.Close()
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
-
-		fmt.Printf("前一区块哈希: %x\n", block.PrevHash)
-		fmt.Printf("当前区块哈希: %x\n", block.Hash)
-
-		pow := blockchain.NewProof(block)
-		fmt.Printf("工作量证明: %s\n", strconv.FormatBool(pow.Validate()))
-
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+		block, err := iter.Next()
+		if err != nil {
+			log.Panic(err)
 		}
-		fmt.Println()
+
+		printBlock(block)
 
 		if len(block.PrevHash) == 0 {
 			break
@@ -108,74 +376,233 @@ func (cli *CommandLine) printChain(nodeID string) {
 	}
 }
 
-// 创建区块链并生成创世区块
-func (cli *CommandLine) createBlockChain(address string, nodeID string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("地址无效")
+// 按高度或哈希打印主链上的一个区块
+func (cli *CommandLine) getBlock(height int, hash string) {
+	chain := cli.openChain()
+	defer chain.Database.Close()
+
+	var block blockchain.Block
+	var err error
+	if hash != "" {
+		blockHash, decodeErr := hex.DecodeString(hash)
+		if decodeErr != nil {
+			log.Panic(decodeErr)
+		}
+		block, err = chain.GetBlock(blockHash)
+	} else {
+		block, err = chain.GetBlockByHeight(height)
 	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	printBlock(&block)
+}
 
-	chain := blockchain.InitBlockChain(address, nodeID)
+// 打印区块头信息及其包含的交易
+func printBlock(block *blockchain.Block) {
+	fmt.Printf("区块高度: %d\n", block.Height)
+	fmt.Printf("前一区块哈希: %x\n", block.PrevHash)
+	fmt.Printf("当前区块哈希: %x\n", block.Hash)
+	fmt.Printf("区块头版本: %d\n", block.Version)
+	fmt.Printf("Merkle 根: %x\n", block.MerkleRoot)
+	fmt.Printf("时间戳: %d\n", block.Timestamp)
+	fmt.Printf("难度目标: %08x\n", block.Bits)
+
+	pow := blockchain.NewProof(block)
+	fmt.Printf("工作量证明: %s\n", strconv.FormatBool(pow.Validate()))
+
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+}
+
+// 生成并打印交易的 Merkle 包含证明
+func (cli *CommandLine) getMerkleProof(txid, node string) {
+	txID, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Panic("交易 ID 无效")
+	}
+
+	chain := cli.openChain()
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-	UTXOSet.Reindex()
+	var proof *blockchain.TxProof
+	if node != "" {
+		proof, err = network.RequestProof(cli.params, node, txID)
+	} else {
+		proof, err = chain.GetTxProof(txID)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Printf("交易: %x\n", proof.Transaction.ID)
+	fmt.Printf("区块哈希: %x\n", proof.BlockHash)
+	fmt.Printf("区块高度: %d\n", proof.Header.Height)
+	fmt.Printf("Merkle 根: %x\n", proof.Header.MerkleRoot)
+	fmt.Printf("叶子位置: %d\n", proof.Proof.Index)
+	fmt.Printf("叶子哈希: %x\n", proof.Proof.Leaf)
+	for i, hash := range proof.Proof.Hashes {
+		fmt.Printf("  第 %d 层兄弟节点: %x\n", i, hash)
+	}
+	fmt.Printf("验证结果: %s\n", strconv.FormatBool(proof.Verify() == nil))
+	if node != "" {
+		// 来自其它节点的证明只有在区块位于本地主链上时才可信，侧链或已被重组断开的区块中的交易可能已经失效
+		onMain, err := chain.IsMainChain(proof.BlockHash, proof.Header.Height)
+		switch {
+		case err != nil:
+			fmt.Println(err)
+		case onMain:
+			fmt.Println("区块状态: 位于本地主链上")
+		case chain.HasBlock(proof.BlockHash):
+			fmt.Println("区块状态: 本地已知，但不在主链上")
+		default:
+			fmt.Println("区块状态: 本地未知")
+		}
+	}
+	fmt.Printf("证明数据: %x\n", proof.Serialize())
+}
+
+// 使用网络的创世区块创建区块链
+func (cli *CommandLine) createBlockChain() {
+	chain, err := blockchain.InitBlockChain(cli.dataDir, cli.params)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	defer chain.Database.Close()
 
-	fmt.Println("创建完成!")
+	fmt.Printf("创建完成! 创世区块: %x\n", chain.LastHash)
 }
 
 // 查询指定地址的余额
-func (cli *CommandLine) getBalance(address, nodeID string) {
-	if !wallet.ValidateAddress(address) {
+func (cli *CommandLine) getBalance(address string) {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
 		log.Panic("地址无效")
 	}
 
-	chain := blockchain.ContinueBlockChain(nodeID)
+	chain := cli.openChain()
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	balance := 0
 	pubKeyHash := wallet.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
 	fmt.Printf("地址的公钥哈希: %x\n", pubKeyHash)
 
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	UTXOs, err := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	if err != nil {
+		log.Panic(err)
+	}
 	fmt.Printf("地址的UTXOs: %+v\n", UTXOs)
 
-	for _, out := range UTXOs {
-		balance += out.Value
+	// 未成熟的 coinbase 输出暂时不能花费，单独显示
+	balance, immature, err := UTXOSet.Balance(pubKeyHash)
+	if err != nil {
+		log.Panic(err)
 	}
-
+	fmt.Printf("未成熟的挖矿奖励: %d\n", immature)
 	fmt.Printf("地址 %s 的余额: %d\n", address, balance)
 }
 
-// 发送交易
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !wallet.ValidateAddress(to) {
+// 统计已发行的货币总量
+func (cli *CommandLine) getSupply() {
+	chain := cli.openChain()
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+	supply, err := UTXOSet.TotalSupply()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("当前高度: %d\n", height)
+	fmt.Printf("已发行总量: %d\n", supply)
+	fmt.Printf("下一区块奖励: %d\n", chain.Params.Subsidy(height+1))
+	if maxSupply := chain.Params.MaxSupply(); maxSupply >= 0 {
+		fmt.Printf("发行上限: %d\n", maxSupply)
+	}
+}
+
+// 在本地立即挖出 n 个区块，每个区块只包含支付给 address 的 coinbase 交易
+func (cli *CommandLine) generate(n int, address string) {
+	if !wallet.ValidateAddress(address, cli.params.AddressVersion) {
 		log.Panic("地址无效")
 	}
 
-	if !wallet.ValidateAddress(from) {
+	chain := cli.openChain()
+	defer chain.Database.Close()
+
+	for i := 0; i < n; i++ {
+		height, err := chain.GetBestHeight()
+		if err != nil {
+			log.Panic(err)
+		}
+		cbTx, err := blockchain.CoinbaseTx(address, "", chain.Params.Subsidy(height+1))
+		if err != nil {
+			log.Panic(err)
+		}
+		block, err := chain.MineBlock(context.Background(), []*blockchain.Transaction{cbTx})
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("区块 %d: %x\n", block.Height, block.Hash)
+	}
+
+	fmt.Printf("完成! 生成了 %d 个区块.\n", n)
+}
+
+// 发送交易，不在本地挖矿时将交易提交给监听在 node 上的节点
+func (cli *CommandLine) send(from, to string, amount, fee int, mineNow bool, node string) {
+	if !wallet.ValidateAddress(to, cli.params.AddressVersion) {
+		log.Panic("地址无效")
+	}
+
+	if !wallet.ValidateAddress(from, cli.params.AddressVersion) {
 		log.Panic("地址无效")
 	}
 
-	chain := blockchain.ContinueBlockChain(nodeID)
+	chain := cli.openChain()
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	wallets, err := wallet.CreateWallets(nodeID)
+	wallets, err := wallet.CreateWallets(cli.dataDir)
 	if err != nil {
 		log.Panic(err)
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	tx, err := blockchain.NewTransaction(&wallet, to, amount, fee, &UTXOSet)
+	if errors.Is(err, blockchain.ErrNotEnoughFunds) {
+		fmt.Println("余额不足:", err)
+		return
+	}
+	if err != nil {
+		log.Panic(err)
+	}
 	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
+		height, err := chain.GetBestHeight()
+		if err != nil {
+			log.Panic(err)
+		}
+		subsidy := chain.Params.Subsidy(height + 1)
+		cbTx, err := blockchain.CoinbaseTx(from, "", subsidy+fee)
+		if err != nil {
+			log.Panic(err)
+		}
 		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		if _, err := chain.MineBlock(context.Background(), txs); err != nil {
+			log.Panic(err)
+		}
 	} else {
-		network.SendTx(network.KnownNodes[0], tx)
+		if err := network.SubmitTx(cli.params, node, tx); err != nil {
+			log.Panic(err)
+		}
 		fmt.Println("交易已发送")
 	}
 
@@ -186,30 +613,60 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 func (cli *CommandLine) Run() {
 	cli.validateArgs()
 
-	nodeID := os.Getenv("NODE_ID")
-	if nodeID == "" {
-		fmt.Printf("NODE_ID 未设置!")
-		runtime.Goexit()
-	}
-
 	// 定义命令和参数
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getMerkleProofCmd := flag.NewFlagSet("getmerkleproof", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxIndexCmd := flag.NewFlagSet("reindex-txindex", flag.ExitOnError)
+	reindexAddrIndexCmd := flag.NewFlagSet("reindex-addrindex", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	addNodeCmd := flag.NewFlagSet("addnode", flag.ExitOnError)
+	removeNodeCmd := flag.NewFlagSet("removenode", flag.ExitOnError)
+	listPeersCmd := flag.NewFlagSet("listpeers", flag.ExitOnError)
 
 	// 设置命令的参数
 	getBalanceAddress := getBalanceCmd.String("address", "", "获取余额的地址")
-	createBlockchainAddress := createBlockchainCmd.String("address", "", "接收创世块奖励的地址")
 	sendFrom := sendCmd.String("from", "", "发送方地址")
 	sendTo := sendCmd.String("to", "", "接收方地址")
 	sendAmount := sendCmd.Int("amount", 0, "发送金额")
+	sendFee := sendCmd.Int("fee", 0, "支付给矿工的手续费")
 	sendMine := sendCmd.Bool("mine", false, "是否在本地立即挖矿")
+	sendNode := sendCmd.String("node", "", "接收交易的节点地址，默认为本机上网络的默认端口")
+	generateCount := generateCmd.Int("n", 1, "生成的区块数量")
+	generateAddress := generateCmd.String("address", "", "接收区块奖励的地址")
+	startNodePort := startNodeCmd.String("port", "", "节点监听的端口，默认为网络的默认端口")
 	startNodeMiner := startNodeCmd.String("miner", "", "启用挖矿模式并设置奖励地址")
+	startNodeSeed := startNodeCmd.String("seed", "", "启动时连接的初始节点，多个地址用逗号分隔")
+	getBlockHeight := getBlockCmd.Int("height", -1, "区块高度")
+	getBlockHash := getBlockCmd.String("hash", "", "区块哈希")
+	getMerkleProofTxID := getMerkleProofCmd.String("txid", "", "交易 ID")
+	getMerkleProofNode := getMerkleProofCmd.String("node", "", "提供证明的全节点地址，为空时使用本地区块链生成证明")
+	historyAddress := historyCmd.String("address", "", "查询交易记录的地址")
+	historyOffset := historyCmd.Int("offset", 0, "跳过的记录数量")
+	historyLimit := historyCmd.Int("limit", 20, "最多显示的记录数量")
+	addNodeAddr := addNodeCmd.String("addr", "", "节点地址，格式为 HOST:PORT")
+	removeNodeAddr := removeNodeCmd.String("addr", "", "节点地址，格式为 HOST:PORT")
+
+	// 所有命令共用的数据目录和网络参数
+	var dataDir, networkName string
+	for _, cmd := range []*flag.FlagSet{
+		getBalanceCmd, createBlockchainCmd, sendCmd, generateCmd, printChainCmd, getBlockCmd,
+		getMerkleProofCmd, createWalletCmd, listAddressesCmd, reindexUTXOCmd, reindexTxIndexCmd,
+		reindexAddrIndexCmd, historyCmd, getSupplyCmd, startNodeCmd, addNodeCmd, removeNodeCmd,
+		listPeersCmd,
+	} {
+		cmd.StringVar(&dataDir, "datadir", defaultDataDir(), "数据根目录")
+		cmd.StringVar(&networkName, "network", blockchain.MainNetParams.Name, "使用的网络: mainnet、testnet 或 regtest")
+	}
 
 	// 解析命令
 	switch os.Args[1] {
@@ -218,6 +675,26 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "reindex-txindex":
+		err := reindexTxIndexCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindex-addrindex":
+		err := reindexAddrIndexCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "history":
+		err := historyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -248,57 +725,168 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getblock":
+		err := getBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getmerkleproof":
+		err := getMerkleProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "generate":
+		err := generateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "addnode":
+		err := addNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "removenode":
+		err := removeNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listpeers":
+		err := listPeersCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
 	}
 
+	params, err := blockchain.ParamsForNetwork(networkName)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	cli.params = params
+	cli.dataDir = params.DataDir(dataDir)
+	cli.migrateLegacyData()
+
 	// 根据解析结果执行相应命令
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		cli.getBalance(*getBalanceAddress)
 	}
 
 	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
+		cli.createBlockChain()
+	}
+
+	if printChainCmd.Parsed() {
+		cli.printChain()
+	}
+
+	if getBlockCmd.Parsed() {
+		if *getBlockHeight < 0 && *getBlockHash == "" {
+			getBlockCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.createBlockChain(*createBlockchainAddress, nodeID)
+		cli.getBlock(*getBlockHeight, *getBlockHash)
 	}
 
-	if printChainCmd.Parsed() {
-		cli.printChain(nodeID)
+	if getMerkleProofCmd.Parsed() {
+		if *getMerkleProofTxID == "" {
+			getMerkleProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getMerkleProof(*getMerkleProofTxID, *getMerkleProofNode)
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet()
 	}
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
+		cli.listAddresses()
 	}
 
 	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO(nodeID)
+		cli.reindexUTXO()
+	}
+
+	if reindexTxIndexCmd.Parsed() {
+		cli.reindexTxIndex()
+	}
+
+	if reindexAddrIndexCmd.Parsed() {
+		cli.reindexAddrIndex()
+	}
+
+	if historyCmd.Parsed() {
+		if *historyAddress == "" || *historyOffset < 0 || *historyLimit <= 0 {
+			historyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.history(*historyAddress, *historyOffset, *historyLimit)
+	}
+
+	if getSupplyCmd.Parsed() {
+		cli.getSupply()
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		if *sendNode == "" {
+			*sendNode = fmt.Sprintf("localhost:%s", params.DefaultPort)
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendMine, *sendNode)
+	}
+
+	if generateCmd.Parsed() {
+		if *generateAddress == "" || *generateCount <= 0 {
+			generateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.generate(*generateCount, *generateAddress)
 	}
 
 	if startNodeCmd.Parsed() {
-		cli.StartNode(nodeID, *startNodeMiner)
+		if *startNodePort == "" {
+			*startNodePort = params.DefaultPort
+		}
+		var seeds []string
+		for _, seed := range strings.Split(*startNodeSeed, ",") {
+			if seed = strings.TrimSpace(seed); seed != "" {
+				seeds = append(seeds, seed)
+			}
+		}
+		cli.StartNode(*startNodePort, *startNodeMiner, seeds)
+	}
+
+	if addNodeCmd.Parsed() {
+		if *addNodeAddr == "" {
+			addNodeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.addNode(*addNodeAddr)
+	}
+
+	if removeNodeCmd.Parsed() {
+		if *removeNodeAddr == "" {
+			removeNodeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.removeNode(*removeNodeAddr)
+	}
+
+	if listPeersCmd.Parsed() {
+		cli.listPeers()
 	}
 }
@@ -0,0 +1,394 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	addrBookFile   = "peers.data"     // 地址簿在数据目录中的文件名
+	maxAddresses   = 1000             // 地址簿最多保存的地址数量
+	maxAddrPerMsg  = 100              // 一条 addr 消息最多包含的地址数量
+	addrHorizon    = 24 * time.Hour   // 超过该时间没有被看到的地址不再转发给其它节点
+	maxAttempts    = 10               // 连续连接失败多少次后从地址簿中删除，手动添加的节点除外
+	baseRetryDelay = 5 * time.Second  // 第一次连接失败后的重试间隔，之后每次失败加倍
+	maxRetryDelay  = 10 * time.Minute // 重试间隔的上限
+)
+
+// KnownAddress 是地址簿中的一个节点地址
+type KnownAddress struct {
+	Addr        string    // 节点监听的地址
+	LastSeen    time.Time // 最近一次得知该节点在线的时间
+	LastAttempt time.Time // 最近一次尝试连接的时间
+	LastSuccess time.Time // 最近一次成功完成握手的时间
+	Attempts    int       // 连续连接失败的次数
+	Manual      bool      // 是否通过 addnode 手动添加，手动添加的节点不会被删除并且始终尝试连接
+}
+
+// retryDelay 返回连接失败后需要等待多久才能再次尝试连接
+func (ka *KnownAddress) retryDelay() time.Duration {
+	if ka.Attempts == 0 {
+		return 0
+	}
+
+	delay := baseRetryDelay
+	for i := 1; i < ka.Attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	return delay
+}
+
+// AddrBook 保存已知节点的地址，节点从中选择要连接的节点，并向其它节点转发地址
+// 所有方法都可以被多个协程同时调用
+// 命令行的 addnode 和 removenode 会在节点运行时直接修改文件，
+// 保存时先合并文件中其它进程所做的修改，避免被内存中的地址簿覆盖
+type AddrBook struct {
+	mu    sync.Mutex
+	path  string // 地址簿文件的路径，为空时只保存在内存中
+	addrs map[string]*KnownAddress
+	dirty bool // 是否有尚未保存的修改
+
+	// 最近一次读取或写入文件时文件中的地址及其是否为手动添加，
+	// 与文件的当前内容比较即可得到其它进程所做的修改
+	saved map[string]bool
+}
+
+// NewAddrBook 创建一个空的地址簿，path 为空时地址簿不会被保存
+func NewAddrBook(path string) *AddrBook {
+	return &AddrBook{path: path, addrs: make(map[string]*KnownAddress), saved: make(map[string]bool)}
+}
+
+// LoadAddrBook 加载数据目录 dataDir 中的地址簿，文件不存在时返回空的地址簿
+func LoadAddrBook(dataDir string) (*AddrBook, error) {
+	book := NewAddrBook(filepath.Join(dataDir, addrBookFile))
+
+	addrs, err := book.readFile()
+	if err != nil {
+		return nil, err
+	}
+	for i := range addrs {
+		book.addrs[addrs[i].Addr] = &addrs[i]
+	}
+	book.setSaved(addrs)
+
+	return book, nil
+}
+
+// readFile 读取地址簿文件中的地址，文件不存在时返回空列表
+func (b *AddrBook) readFile() ([]KnownAddress, error) {
+	content, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []KnownAddress
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&addrs); err != nil {
+		return nil, fmt.Errorf("invalid address book %s: %w", b.path, err)
+	}
+
+	return addrs, nil
+}
+
+// setSaved 记录文件中的地址，调用者需要持有锁或独占地址簿
+func (b *AddrBook) setSaved(addrs []KnownAddress) {
+	b.saved = make(map[string]bool, len(addrs))
+	for _, ka := range addrs {
+		b.saved[ka.Addr] = ka.Manual
+	}
+}
+
+// merge 将其它进程对文件所做的修改合并到内存中的地址簿，调用者需要持有锁
+// 文件中新增的地址被加入，手动标记的变化被应用，从文件中删除的地址也从内存中删除；
+// 文件无法读取时保留内存中的地址簿，随后的保存会覆盖该文件
+func (b *AddrBook) merge() {
+	addrs, err := b.readFile()
+	if err != nil {
+		fmt.Printf("Failed to reload address book: %v\n", err)
+		return
+	}
+
+	onDisk := make(map[string]bool, len(addrs))
+	for i := range addrs {
+		ka := &addrs[i]
+		onDisk[ka.Addr] = true
+
+		manual, known := b.saved[ka.Addr]
+		if known && manual == ka.Manual {
+			continue
+		}
+		if cur, ok := b.addrs[ka.Addr]; ok {
+			if cur.Manual != ka.Manual {
+				cur.Manual = ka.Manual
+				cur.Attempts = 0
+			}
+		} else if !known || ka.Manual {
+			b.addrs[ka.Addr] = ka
+		}
+		b.dirty = true
+	}
+	for addr := range b.saved {
+		if !onDisk[addr] {
+			delete(b.addrs, addr)
+			b.dirty = true
+		}
+	}
+	b.evict()
+
+	b.setSaved(addrs)
+}
+
+// Save 合并文件中其它进程所做的修改后将地址簿写入文件，目录不存在时自动创建
+func (b *AddrBook) Save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.merge()
+
+	list := b.list()
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(list); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+
+	// 先写入临时文件再重命名，避免写入过程中退出导致文件损坏
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.setSaved(list)
+	b.dirty = false
+
+	return nil
+}
+
+// SaveIfChanged 在地址簿有修改时写入文件，并合并其它进程对文件所做的修改
+// 节点定期调用该方法，运行期间通过命令行添加或删除的节点由此生效
+func (b *AddrBook) SaveIfChanged() error {
+	if b.path == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	b.merge()
+	dirty := b.dirty
+	b.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+	return b.Save()
+}
+
+// Add 记录在 seen 时刻得知在线的节点地址，地址原来不在地址簿中时返回 true
+// 格式无效的地址被忽略
+func (b *AddrBook) Add(addr string, seen time.Time) bool {
+	if !validAddr(addr) {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ka, ok := b.addrs[addr]; ok {
+		if seen.After(ka.LastSeen) {
+			ka.LastSeen = seen
+			b.dirty = true
+		}
+		return false
+	}
+
+	b.addrs[addr] = &KnownAddress{Addr: addr, LastSeen: seen}
+	b.dirty = true
+	b.evict()
+
+	return true
+}
+
+// AddManual 将地址作为手动添加的节点加入地址簿，地址格式无效时返回错误
+func (b *AddrBook) AddManual(addr string) error {
+	if !validAddr(addr) {
+		return fmt.Errorf("invalid node address %q, expected host:port", addr)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr}
+		b.addrs[addr] = ka
+	}
+	ka.Manual = true
+	ka.Attempts = 0
+	b.dirty = true
+
+	return nil
+}
+
+// Remove 从地址簿中删除地址，地址不存在时返回 false
+func (b *AddrBook) Remove(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.addrs[addr]; !ok {
+		return false
+	}
+	delete(b.addrs, addr)
+	b.dirty = true
+
+	return true
+}
+
+// Attempt 记录一次连接尝试
+func (b *AddrBook) Attempt(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ka, ok := b.addrs[addr]; ok {
+		ka.LastAttempt = time.Now()
+		b.dirty = true
+	}
+}
+
+// Failed 记录一次失败的连接，连续失败 maxAttempts 次的地址被删除
+func (b *AddrBook) Failed(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.Attempts++
+	if ka.Attempts >= maxAttempts && !ka.Manual {
+		delete(b.addrs, addr)
+	}
+	b.dirty = true
+}
+
+// Good 记录一次成功完成握手的连接，地址不在地址簿中时将其加入
+func (b *AddrBook) Good(addr string) {
+	if !validAddr(addr) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr}
+		b.addrs[addr] = ka
+		b.evict()
+	}
+	now := time.Now()
+	ka.LastSeen = now
+	ka.LastSuccess = now
+	ka.Attempts = 0
+	b.dirty = true
+}
+
+// Addresses 返回地址簿中的所有地址，按最近看到的时间从新到旧排列
+func (b *AddrBook) Addresses() []KnownAddress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.list()
+}
+
+// Recent 返回最多 max 个最近 addrHorizon 内看到过的地址，用于回复 getaddr
+func (b *AddrBook) Recent(max int) []NetAddress {
+	now := time.Now()
+	var recent []NetAddress
+
+	for _, ka := range b.Addresses() {
+		if len(recent) >= max || now.Sub(ka.LastSeen) > addrHorizon {
+			break
+		}
+		recent = append(recent, NetAddress{ka.Addr, ka.LastSeen.Unix()})
+	}
+
+	return recent
+}
+
+// Candidates 返回当前可以尝试连接的地址：手动添加的地址在前，其余按最近看到的时间排列
+// 连接失败的地址需要等待按失败次数加倍的重试间隔
+func (b *AddrBook) Candidates() []KnownAddress {
+	now := time.Now()
+	var manual, others []KnownAddress
+
+	for _, ka := range b.Addresses() {
+		if now.Sub(ka.LastAttempt) < ka.retryDelay() {
+			continue
+		}
+		if ka.Manual {
+			manual = append(manual, ka)
+		} else {
+			others = append(others, ka)
+		}
+	}
+
+	return append(manual, others...)
+}
+
+// list 返回按最近看到的时间从新到旧排列的地址，调用者需要持有锁
+func (b *AddrBook) list() []KnownAddress {
+	list := make([]KnownAddress, 0, len(b.addrs))
+	for _, ka := range b.addrs {
+		list = append(list, *ka)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].LastSeen.Equal(list[j].LastSeen) {
+			return list[i].LastSeen.After(list[j].LastSeen)
+		}
+		return list[i].Addr < list[j].Addr
+	})
+
+	return list
+}
+
+// evict 地址数量超过上限时删除最久没有看到的非手动地址，调用者需要持有锁
+func (b *AddrBook) evict() {
+	for len(b.addrs) > maxAddresses {
+		var oldest *KnownAddress
+		for _, ka := range b.addrs {
+			if !ka.Manual && (oldest == nil || ka.LastSeen.Before(oldest.LastSeen)) {
+				oldest = ka
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(b.addrs, oldest.Addr)
+	}
+}
+
+// validAddr 检查地址是否为 host:port 格式
+func validAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && port != ""
+}
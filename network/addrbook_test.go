@@ -0,0 +1,91 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// 节点运行时命令行对地址簿文件的修改在节点保存时被合并，而不是被覆盖
+func TestAddrBookMergesFileChanges(t *testing.T) {
+	dir := t.TempDir()
+	seen := time.Now()
+
+	node, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Add("a:1", seen)
+	node.Add("b:2", seen)
+	if err := node.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 命令行加载文件，添加一个节点并删除一个节点
+	cli, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.AddManual("c:3"); err != nil {
+		t.Fatal(err)
+	}
+	cli.Remove("a:1")
+	if err := cli.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 节点在内存中继续修改地址簿后保存
+	node.Good("a:1")
+	node.Add("d:4", seen)
+	if err := node.SaveIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"b:2": false, "c:3": true, "d:4": false}
+	for name, book := range map[string]*AddrBook{"node": node, "file": mustLoadAddrBook(t, dir)} {
+		got := make(map[string]bool)
+		for _, ka := range book.Addresses() {
+			got[ka.Addr] = ka.Manual
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s addresses = %v, want %v", name, got, want)
+			continue
+		}
+		for addr, manual := range want {
+			if m, ok := got[addr]; !ok || m != manual {
+				t.Errorf("%s addresses = %v, want %v", name, got, want)
+				break
+			}
+		}
+	}
+}
+
+// 文件没有被其它进程修改时，合并不会恢复节点自己删除的地址
+func TestAddrBookKeepsLocalRemoval(t *testing.T) {
+	dir := t.TempDir()
+
+	book, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.Add("a:1", time.Now())
+	if err := book.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	book.Remove("a:1")
+	if err := book.SaveIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := mustLoadAddrBook(t, dir).Addresses(); len(addrs) != 0 {
+		t.Errorf("addresses after removal = %v, want none", addrs)
+	}
+}
+
+func mustLoadAddrBook(t *testing.T, dir string) *AddrBook {
+	t.Helper()
+	book, err := LoadAddrBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return book
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 消息格式：魔数（4 字节）| 命令（commandLength 字节，不足部分补 0）|
+// 载荷长度（4 字节，大端序）| 载荷校验和（4 字节）| 载荷
+// 校验和是载荷两次 SHA-256 哈希的前 4 字节，长度前缀使同一个连接可以连续发送多条消息
+const (
+	messageHeaderSize = 4 + commandLength + 4 + checksumLength
+	checksumLength    = 4
+	MaxMessageSize    = 32 << 20 // 载荷的最大字节数，超过时拒绝该消息
+)
+
+// 读取消息时可能返回的错误，出现这些错误后连接中的数据已经无法继续解析
+var (
+	ErrBadMagic        = errors.New("message is from a different network")
+	ErrBadCommand      = errors.New("message command is malformed")
+	ErrBadChecksum     = errors.New("message checksum does not match payload")
+	ErrMessageTooLarge = errors.New("message payload is too large")
+)
+
+// Message 表示一条网络消息
+type Message struct {
+	Command string // 命令名称
+	Payload []byte // gob 编码的命令数据
+}
+
+// checksum 计算载荷的校验和
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:checksumLength]
+}
+
+// writeMessage 将命令和载荷按照消息格式写入 w
+func writeMessage(w io.Writer, magic [4]byte, command string, payload []byte) error {
+	if len(command) == 0 || len(command) > commandLength {
+		return fmt.Errorf("%w: %q", ErrBadCommand, command)
+	}
+	if len(payload) > MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, len(payload))
+	}
+
+	header := make([]byte, 0, messageHeaderSize)
+	header = append(header, magic[:]...)
+	header = append(header, CmdToBytes(command)...)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(payload)))
+	header = append(header, checksum(payload)...)
+
+	// 头部和载荷一次写入，避免多个协程写同一个连接时消息交错
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readMessage 从 r 中读取一条完整的消息
+// 连接在两条消息之间关闭时返回 io.EOF，消息不完整时返回 io.ErrUnexpectedEOF，
+// 魔数、命令、长度或校验和无效时返回对应的错误
+func readMessage(r io.Reader, magic [4]byte) (*Message, error) {
+	header := make([]byte, messageHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], magic[:]) {
+		return nil, fmt.Errorf("%w: magic %x", ErrBadMagic, header[:4])
+	}
+
+	command, err := parseCommand(header[4 : 4+commandLength])
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	if length > MaxMessageSize {
+		return nil, fmt.Errorf("%w: %s with %d bytes", ErrMessageTooLarge, command, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if !bytes.Equal(header[messageHeaderSize-checksumLength:], checksum(payload)) {
+		return nil, fmt.Errorf("%w: %s", ErrBadChecksum, command)
+	}
+
+	return &Message{command, payload}, nil
+}
+
+// parseCommand 解析消息头中的命令，命令由可打印的 ASCII 字符组成，之后只能是补齐的 0
+func parseCommand(field []byte) (string, error) {
+	end := bytes.IndexByte(field, 0)
+	if end < 0 {
+		end = len(field)
+	}
+	if end == 0 {
+		return "", fmt.Errorf("%w: empty", ErrBadCommand)
+	}
+
+	for i, b := range field {
+		if (i < end && (b < 0x21 || b > 0x7e)) || (i >= end && b != 0) {
+			return "", fmt.Errorf("%w: %x", ErrBadCommand, field)
+		}
+	}
+
+	return string(field[:end]), nil
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+var testMagic = [4]byte{0x01, 0x02, 0x03, 0x04}
+
+// encodeMessage 返回按照消息格式编码的消息
+func encodeMessage(t *testing.T, command string, payload []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, testMagic, command, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		{"version", []byte("payload")},
+		{"verack", nil},
+		{"abcdefghijkl", bytes.Repeat([]byte{0xff}, 1000)},
+	}
+
+	// 同一个连接中连续发送的消息依次被读出
+	var stream []byte
+	for _, msg := range messages {
+		stream = append(stream, encodeMessage(t, msg.Command, msg.Payload)...)
+	}
+
+	r := bytes.NewReader(stream)
+	for _, want := range messages {
+		got, err := readMessage(r, testMagic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Command != want.Command || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("read %q %x, want %q %x", got.Command, got.Payload, want.Command, want.Payload)
+		}
+	}
+	if _, err := readMessage(r, testMagic); err != io.EOF {
+		t.Fatalf("read after last message = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	valid := encodeMessage(t, "block", []byte("some block data"))
+	lengthOffset := 4 + commandLength
+
+	// modify 返回修改后的消息副本
+	modify := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"bad magic", modify(func(data []byte) []byte {
+			data[0] ^= 0xff
+			return data
+		}), ErrBadMagic},
+		{"bad checksum", modify(func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}), ErrBadChecksum},
+		{"empty command", modify(func(data []byte) []byte {
+			copy(data[4:], make([]byte, commandLength))
+			return data
+		}), ErrBadCommand},
+		{"unprintable command", modify(func(data []byte) []byte {
+			data[5] = ' '
+			return data
+		}), ErrBadCommand},
+		{"data after padding", modify(func(data []byte) []byte {
+			data[4+commandLength-1] = 'x'
+			return data
+		}), ErrBadCommand},
+		{"length over maximum", modify(func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[lengthOffset:], MaxMessageSize+1)
+			return data
+		}), ErrMessageTooLarge},
+		{"truncated header", valid[:messageHeaderSize-1], io.ErrUnexpectedEOF},
+		{"missing payload", valid[:messageHeaderSize], io.ErrUnexpectedEOF},
+		{"truncated payload", valid[:len(valid)-1], io.ErrUnexpectedEOF},
+		{"empty", nil, io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := readMessage(bytes.NewReader(tt.data), testMagic)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("readMessage = %v, %v, want error %v", msg, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		payload []byte
+		want    error
+	}{
+		{"empty command", "", nil, ErrBadCommand},
+		{"long command", "abcdefghijklm", nil, ErrBadCommand},
+		{"payload over maximum", "block", make([]byte, MaxMessageSize+1), ErrMessageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeMessage(&buf, testMagic, tt.command, tt.payload); !errors.Is(err, tt.want) {
+				t.Fatalf("writeMessage = %v, want %v", err, tt.want)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes written for an invalid message", buf.Len())
+			}
+		})
+	}
+}
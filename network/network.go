@@ -2,16 +2,18 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
-	"syscall"
-	"runtime"
 	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/vrecan/death/v3"
 
@@ -19,60 +21,62 @@ import (
 )
 
 const (
-	protocol      = "tcp"           // 网络协议，使用 TCP
-	version       = 1               // 协议版本
-	commandLength = 12              // 命令的长度
-)
-
-var (
-	nodeAddress     string                      // 当前节点地址
-	mineAddress     string                      // 挖矿地址
-	KnownNodes      = []string{"localhost:3000"} // 已知节点列表
-	blocksInTransit = [][]byte{}               // 正在传输的区块
-	memoryPool      = make(map[string]blockchain.Transaction) // 存储未确认的交易
+	protocol      = "tcp"   // 网络协议，使用 TCP
+	version       = 3       // 协议版本，版本 3 的 addr 消息带有时间戳
+	commandLength = 12      // 命令的长度
+	maxBlockSize  = 1 << 16 // 挖矿时打包的交易总大小上限（字节）
 )
 
 // Addr 类型表示节点地址列表
 type Addr struct {
-	AddrList []string
+	Addresses []NetAddress
 }
 
-// Block 类型表示一个区块，包含发送方地址和区块数据
-type Block struct {
-	AddrFrom string
-	Block    []byte
+// NetAddress 是 addr 消息中的一个节点地址
+type NetAddress struct {
+	Addr      string // 节点监听的地址
+	Timestamp int64  // 发送方最近一次得知该节点在线的时间（Unix 秒）
 }
 
-// GetBlocks 类型表示获取区块的请求
-type GetBlocks struct {
-	AddrFrom string
+// Block 类型表示一个区块
+type Block struct {
+	Block []byte
 }
 
 // GetData 类型表示获取数据（区块或交易）的请求
 type GetData struct {
-	AddrFrom string
-	Type     string
-	ID       []byte
+	Type string
+	ID   []byte
 }
 
 // Inv 类型表示节点的库存（区块或交易）
 type Inv struct {
-	AddrFrom string
-	Type     string
-	Items    [][]byte
+	Type  string
+	Items [][]byte
+}
+
+// GetProof 类型表示获取交易包含证明的请求
+type GetProof struct {
+	TxID []byte
+}
+
+// Proof 类型表示交易包含证明，Proof 为规范编码的 blockchain.TxProof
+type Proof struct {
+	Proof []byte
 }
 
 // Tx 类型表示交易数据
 type Tx struct {
-	AddrFrom    string
 	Transaction []byte
 }
 
-// Version 类型表示协议版本及区块链的高度
+// Version 类型是握手时交换的节点信息
 type Version struct {
-	Version    int
-	BestHeight int
-	AddrFrom   string
+	Version     int
+	Services    uint64 // 发送方提供的服务
+	BestHeight  int
+	AddrFrom    string // 发送方监听的地址，不接受连接时为空
+	GenesisHash []byte // 发送方区块链的创世区块哈希，不同的节点属于不同的网络
 }
 
 // CmdToBytes 将命令字符串转换为字节数组
@@ -86,420 +90,724 @@ func CmdToBytes(cmd string) []byte {
 	return bytes[:]
 }
 
-// BytesToCmd 将字节数组转换为命令字符串
-func BytesToCmd(bytes []byte) string {
-	var cmd []byte
-
-	for _, b := range bytes {
-		if b != 0x0 {
-			cmd = append(cmd, b)
-		}
+// SubmitTx 将交易发送到 params 网络中地址为 addr 的节点
+// 供不运行节点的命令行客户端使用：完成握手、发送交易后立即断开连接
+func SubmitTx(params *blockchain.ChainParams, addr string, tnx *blockchain.Transaction) error {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return err
 	}
+	p := newPeer(conn, params.Magic, false)
+	defer p.Disconnect()
 
-	return string(cmd)
-}
-
-// ExtractCmd 从请求中提取命令部分
-func ExtractCmd(request []byte) []byte {
-	return request[:commandLength]
-}
-
-// RequestBlocks 向已知节点请求区块
-func RequestBlocks() {
-	for _, node := range KnownNodes {
-		SendGetBlocks(node)
+	// 命令行客户端不接受连接，也不提供任何服务
+	local := &Version{version, 0, 0, "", params.Genesis.Hash}
+	if err := p.handshake(local); err != nil {
+		return err
 	}
-}
-
-// SendAddr 发送节点地址的请求
-func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := GobEncode(nodes)
-	request := append(CmdToBytes("addr"), payload...)
-
-	SendData(address, request)
-}
 
-// SendBlock 发送区块数据
-func SendBlock(addr string, b *blockchain.Block) {
-	data := Block{nodeAddress, b.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("block"), payload...)
-
-	SendData(addr, request)
+	return writeMessage(conn, params.Magic, "tx", GobEncode(Tx{tnx.Serialize()}))
 }
 
-// SendData 发送数据到指定地址
-func SendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-
+// RequestProof 向 params 网络中地址为 addr 的全节点请求交易的包含证明
+// 供不运行节点的命令行客户端使用，返回的证明已经通过验证；
+// 证明只说明交易包含在该区块中，区块是否位于认可的链上由调用者检查
+func RequestProof(params *blockchain.ChainParams, addr string, txID []byte) (*blockchain.TxProof, error) {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
 	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		KnownNodes = updatedNodes
-
-		return
+		return nil, err
 	}
+	p := newPeer(conn, params.Magic, false)
+	defer p.Disconnect()
 
-	defer conn.Close()
-
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+	local := &Version{version, 0, 0, "", params.Genesis.Hash}
+	if err := p.handshake(local); err != nil {
+		return nil, err
 	}
-}
 
-// SendInv 发送库存（区块或交易）数据
-func SendInv(address, kind string, items [][]byte) {
-	inventory := Inv{nodeAddress, kind, items}
-	payload := GobEncode(inventory)
-	request := append(CmdToBytes("inv"), payload...)
+	go p.writeLoop()
+	p.SendGetProof(txID)
 
-	SendData(address, request)
-}
-
-// SendGetBlocks 发送获取区块请求
-func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
-	request := append(CmdToBytes("getblocks"), payload...)
+	conn.SetReadDeadline(time.Now().Add(proofTimeout))
+	for {
+		msg, err := readMessage(conn, params.Magic)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%s did not return a proof for transaction %x", addr, txID)
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	SendData(address, request)
-}
+		// 握手之后节点可能先发送 addr 等其它消息，直接忽略
+		if msg.Command != "proof" {
+			continue
+		}
 
-// SendGetData 发送获取数据请求（区块或交易）
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{nodeAddress, kind, id})
-	request := append(CmdToBytes("getdata"), payload...)
+		var payload Proof
+		if err := decodePayload(msg.Payload, &payload); err != nil {
+			return nil, err
+		}
+		proof, err := blockchain.DeserializeTxProof(payload.Proof)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(proof.Transaction.ID, txID) {
+			return nil, fmt.Errorf("%s returned a proof for transaction %x", addr, proof.Transaction.ID)
+		}
+		if err := proof.Verify(); err != nil {
+			return nil, err
+		}
 
-	SendData(address, request)
+		return proof, nil
+	}
 }
 
-// SendTx 发送交易数据
-func SendTx(addr string, tnx *blockchain.Transaction) {
-	data := Tx{nodeAddress, tnx.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("tx"), payload...)
-
-	SendData(addr, request)
-}
+// HandleAddr 处理节点地址请求
+func (n *Node) HandleAddr(p *Peer, data []byte) error {
+	var payload Addr
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
-// SendVersion 发送版本信息
-func SendVersion(addr string, chain *blockchain.BlockChain) {
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+	if len(payload.Addresses) > maxAddrPerMsg {
+		return fmt.Errorf("too many addresses: %d", len(payload.Addresses))
+	}
 
-	request := append(CmdToBytes("version"), payload...)
+	// 新地址加入地址簿，由连接管理器决定是否连接
+	now := time.Now()
+	var fresh []NetAddress
+	for _, a := range payload.Addresses {
+		seen := time.Unix(a.Timestamp, 0)
+		if seen.After(now.Add(maxClockSkew)) {
+			seen = now
+		}
+		if now.Sub(seen) > addrHorizon || a.Addr == n.address {
+			continue
+		}
 
-	SendData(addr, request)
-}
+		if n.addrBook.Add(a.Addr, seen) {
+			fresh = append(fresh, NetAddress{a.Addr, seen.Unix()})
+		}
+	}
+	fmt.Printf("Received %d addresses from %s, %d new\n", len(payload.Addresses), p, len(fresh))
 
-// HandleAddr 处理节点地址请求
-func HandleAddr(request []byte) {
-	var buff bytes.Buffer
-	var payload Addr
+	// 地址较少的 addr 消息是节点主动广播的地址，将其中的新地址转发给少数几个节点，
+	// 使地址在网络中传播；回复 getaddr 的消息地址较多，不再转发
+	// Peers 返回的顺序不固定，相当于随机选择转发的节点
+	if len(fresh) == 0 || len(payload.Addresses) > addrRelayMax {
+		return nil
+	}
+	relayed := 0
+	for _, peer := range n.Peers() {
+		if relayed >= addrRelayPeers {
+			break
+		}
+		if peer != p && peer.Version >= addrTimeVersion {
+			peer.SendAddr(fresh)
+			relayed++
+		}
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	return nil
+}
 
-	}
+// HandleGetAddr 处理获取地址请求，回复地址簿中最近看到过的地址
+func (n *Node) HandleGetAddr(p *Peer) error {
+	p.SendAddr(n.addrBook.Recent(maxAddrPerMsg))
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
-	RequestBlocks()
+	return nil
 }
 
 // HandleBlock 处理区块请求
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) HandleBlock(p *Peer, data []byte) error {
 	var payload Block
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
 	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.Deserialize(blockData)
+	if err != nil {
+		fmt.Printf("Invalid block from %s: %v\n", p, err)
+		return nil
+	}
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
+
+	lastHash := n.chain.Tip()
+	err = n.chain.AddBlock(block)
+	if errors.Is(err, blockchain.ErrOrphanBlock) {
+		// 父区块未知时向发送方请求完整的区块列表，补齐缺失的祖先区块
+		fmt.Printf("Orphan block %x, requesting ancestors\n", block.Hash)
+		p.SendGetBlocks()
+		return nil
+	}
+	if err != nil {
+		// 无效区块的后续区块也无法连接，放弃从该节点的本次同步
+		fmt.Printf("Rejected block: %v\n", err)
+		p.blocksInTransit = nil
+		return nil
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	// 链头发生变化后，正在挖的区块已经过时
+	tip := n.chain.Tip()
+	tipChanged := !bytes.Equal(lastHash, tip)
+	if tipChanged {
+		n.StopMining()
+	}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-		UTXOSet.Reindex()
+	// 继续向发送该区块的节点请求它告知的下一个区块
+	if len(p.blocksInTransit) > 0 {
+		blockHash := p.blocksInTransit[0]
+		p.blocksInTransit = p.blocksInTransit[1:]
+		p.SendGetData("block", blockHash)
+		return nil
 	}
+
+	// 同步完成且链头发生变化时，将新的链头转发给除发送方以外的所有节点
+	// 缺少中间区块的节点收到后会作为孤块处理并请求完整的区块列表
+	if tipChanged {
+		for _, peer := range n.Peers() {
+			if peer != p {
+				peer.SendInv("block", [][]byte{tip})
+			}
+		}
+	}
+
+	return nil
 }
 
 // HandleInv 处理库存请求（区块或交易）
-func HandleInv(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) HandleInv(p *Peer, data []byte) error {
 	var payload Inv
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+		// 库存按照从链头到创世块的顺序排列，跳过已有的区块后
+		// 反转为从低到高的顺序请求，保证每个区块到达时父区块已经存在
+		newInTransit := [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if !n.chain.HasBlock(payload.Items[i]) {
+				newInTransit = append(newInTransit, payload.Items[i])
+			}
+		}
 
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+		if len(newInTransit) == 0 {
+			return nil
+		}
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if !bytes.Equal(b, blockHash) {
-				newInTransit = append(newInTransit, b)
+		// 正在从该节点同步时，新的区块排在队列末尾，由 HandleBlock 依次请求
+		if len(p.blocksInTransit) > 0 {
+			queued := make(map[string]bool, len(p.blocksInTransit))
+			for _, hash := range p.blocksInTransit {
+				queued[hex.EncodeToString(hash)] = true
 			}
+			for _, hash := range newInTransit {
+				if !queued[hex.EncodeToString(hash)] {
+					p.blocksInTransit = append(p.blocksInTransit, hash)
+				}
+			}
+			return nil
 		}
-		blocksInTransit = newInTransit
+
+		// 区块只向告知它们的节点请求，不同节点的同步互不影响
+		p.blocksInTransit = newInTransit[1:]
+		p.SendGetData("block", newInTransit[0])
 	}
 
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
+		for _, txID := range payload.Items {
+			n.mu.Lock()
+			_, known := n.memoryPool[hex.EncodeToString(txID)]
+			n.mu.Unlock()
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+			if !known {
+				p.SendGetData("tx", txID)
+			}
 		}
 	}
-}
 
-// HandleGetBlocks 处理获取区块请求
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
-	var payload GetBlocks
+	return nil
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+// HandleGetBlocks 处理获取区块请求，回复主链上所有区块的哈希
+func (n *Node) HandleGetBlocks(p *Peer) error {
+	blocks, err := n.chain.GetBlockHashes()
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to list blocks: %v\n", err)
+		return nil
 	}
+	p.SendInv("block", blocks)
 
-	blocks := chain.GetBlockHashes()
-	SendInv(payload.AddrFrom, "block", blocks)
+	return nil
 }
 
 // HandleGetData 处理获取数据请求（区块或交易）
-func HandleGetData(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) HandleGetData(p *Peer, data []byte) error {
 	var payload GetData
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
 	}
 
 	if payload.Type == "block" {
-		block, err := chain.GetBlock([]byte(payload.ID))
+		block, err := n.chain.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			return nil
 		}
 
-		SendBlock(payload.AddrFrom, &block)
+		p.SendBlock(&block)
 	}
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
 
-		SendTx(payload.AddrFrom, &tx)
+		n.mu.Lock()
+		tx, ok := n.memoryPool[txID]
+		n.mu.Unlock()
+
+		if ok {
+			p.SendTx(&tx)
+		}
+	}
+
+	return nil
+}
+
+// HandleGetProof 处理获取交易包含证明的请求
+func (n *Node) HandleGetProof(p *Peer, data []byte) error {
+	var payload GetProof
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+
+	proof, err := n.chain.GetTxProof(payload.TxID)
+	if err != nil {
+		fmt.Printf("No proof for transaction %x: %v\n", payload.TxID, err)
+		return nil
+	}
+
+	p.SendProof(proof)
+
+	return nil
+}
+
+// HandleProof 处理收到的交易包含证明
+func (n *Node) HandleProof(p *Peer, data []byte) error {
+	var payload Proof
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+
+	proof, err := blockchain.DeserializeTxProof(payload.Proof)
+	if err != nil {
+		fmt.Printf("Invalid proof from %s: %v\n", p, err)
+		return nil
+	}
+	if err := proof.Verify(); err != nil {
+		fmt.Printf("Invalid proof for transaction %x: %v\n", proof.Transaction.ID, err)
+		return nil
 	}
+
+	// 证明只说明交易包含在该区块中，区块本身还需要位于本地主链上
+	// 侧链或已被重组断开的区块中的交易可能已经失效
+	onMain, err := n.chain.IsMainChain(proof.BlockHash, proof.Header.Height)
+	if err != nil {
+		fmt.Printf("Checking block %x failed: %v\n", proof.BlockHash, err)
+		return nil
+	}
+	if !onMain {
+		if n.chain.HasBlock(proof.BlockHash) {
+			fmt.Printf("Transaction %x is in block %x, which is not on the main chain\n", proof.Transaction.ID, proof.BlockHash)
+		} else {
+			fmt.Printf("Transaction %x is in block %x, which is not known locally\n", proof.Transaction.ID, proof.BlockHash)
+		}
+		return nil
+	}
+	fmt.Printf("Transaction %x is proven in block %x at height %d\n", proof.Transaction.ID, proof.BlockHash, proof.Header.Height)
+
+	return nil
 }
 
 // HandleTx 处理交易数据请求
-func HandleTx(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) HandleTx(p *Peer, data []byte) error {
 	var payload Tx
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	txData := payload.Transaction
+	tx, err := blockchain.DeserializeTransaction(txData)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Invalid transaction from %s: %v\n", p, err)
+		return nil
+	}
+
+	// 无效的交易不加入内存池也不转发，避免在网络中传播
+	UTXOSet := blockchain.UTXOSet{Blockchain: n.chain}
+	if fee, err := UTXOSet.TransactionFee(&tx); err != nil || fee < 0 {
+		fmt.Printf("Rejected transaction %x from %s: inputs are not spendable\n", tx.ID, p)
+		return nil
+	}
+	if err := n.chain.VerifyTransaction(&tx); err != nil {
+		fmt.Printf("Rejected transaction %x from %s: %v\n", tx.ID, p, err)
+		return nil
+	}
+
+	txID := hex.EncodeToString(tx.ID)
+	n.mu.Lock()
+	_, known := n.memoryPool[txID]
+	if !known {
+		// 与内存池中的交易花费同一输出的交易无法同时被打包，保留先收到的交易
+		if other := n.poolConflict(&tx); other != nil {
+			n.mu.Unlock()
+			fmt.Printf("Rejected transaction %x from %s: conflicts with %x in memory pool\n", tx.ID, p, other.ID)
+			return nil
+		}
 	}
+	n.memoryPool[txID] = tx
+	poolSize := len(n.memoryPool)
+	n.mu.Unlock()
 
-	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	// 已经收到过的交易不再转发，避免交易在节点之间循环
+	if known {
+		return nil
+	}
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	fmt.Printf("%s, %d\n", n.address, poolSize)
 
-	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				SendInv(node, "tx", [][]byte{tx.ID})
-			}
+	// 新交易转发给除发送方以外的所有节点
+	for _, peer := range n.Peers() {
+		if peer != p {
+			peer.SendInv("tx", [][]byte{tx.ID})
 		}
-	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-			MineTx(chain)
+	}
+
+	// 在单独的协程中挖矿，挖矿期间仍然可以收到新区块并取消挖矿
+	if poolSize >= 2 && len(n.mineAddress) > 0 {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.MineTx()
+		}()
+	}
+
+	return nil
+}
+
+// poolConflict 返回内存池中与 tx 花费同一输出的其它交易，没有冲突时返回 nil
+// 调用者必须持有 n.mu
+func (n *Node) poolConflict(tx *blockchain.Transaction) *blockchain.Transaction {
+	spent := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] = true
+	}
+
+	for _, other := range n.memoryPool {
+		if bytes.Equal(other.ID, tx.ID) {
+			continue
 		}
+		for _, in := range other.Inputs {
+			if spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] {
+				return &other
+			}
+		}
+	}
+	return nil
+}
+
+// MineTx 打包内存池中的交易挖掘新区块，直到内存池为空或没有可以打包的交易
+// 已经在挖矿时直接返回
+func (n *Node) MineTx() {
+	n.miningMutex.Lock()
+	if n.mining {
+		n.miningMutex.Unlock()
+		return
+	}
+	n.mining = true
+	n.miningMutex.Unlock()
+
+	// 挖出区块后继续打包内存池中剩余的交易
+	for n.mineBlock() && n.poolSize() > 0 {
 	}
+
+	n.miningMutex.Lock()
+	n.mining = false
+	n.miningMutex.Unlock()
+}
+
+// poolSize 返回内存池中的交易数量
+func (n *Node) poolSize() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return len(n.memoryPool)
 }
 
-// MineTx 挖掘新区块
-func MineTx(chain *blockchain.BlockChain) {
-	// 从内存池中获取有效交易并生成新区块
+// mineBlock 按照手续费率选择内存池中的交易挖掘一个新区块，成功挖出区块时返回 true
+func (n *Node) mineBlock() bool {
+	// 从内存池中获取有效交易，计算每笔交易的手续费率
+	type candidate struct {
+		tx   *blockchain.Transaction
+		fee  int
+		size int
+	}
+	var candidates []candidate
+	UTXOSet := blockchain.UTXOSet{Blockchain: n.chain}
+
+	// 新区块的父区块在开始时确定，coinbase 奖励按照父区块的高度计算
+	parent := n.chain.Tip()
+	parentHeader, err := n.chain.GetHeader(parent)
+	if err != nil {
+		fmt.Printf("Mining failed: %v\n", err)
+		return false
+	}
+
+	// 验证交易需要读取数据库，先复制内存池，避免验证期间一直持有锁
+	n.mu.Lock()
+	pool := make(map[string]blockchain.Transaction, len(n.memoryPool))
+	for id, tx := range n.memoryPool {
+		pool[id] = tx
+	}
+	n.mu.Unlock()
+
+	for id := range pool {
+		fmt.Printf("tx: %s\n", pool[id].ID)
+		tx := pool[id]
+
+		// 输入已被花费的交易无法再被打包，从内存池中删除
+		fee, err := UTXOSet.TransactionFee(&tx)
+		if err != nil || fee < 0 {
+			n.mu.Lock()
+			delete(n.memoryPool, id)
+			n.mu.Unlock()
+			continue
+		}
+		if err := n.chain.VerifyTransaction(&tx); err != nil {
+			continue
+		}
+
+		candidates = append(candidates, candidate{&tx, fee, len(tx.Serialize())})
+	}
+
+	// 按照手续费率（每字节手续费）从高到低打包交易
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+	})
+
 	var txs []*blockchain.Transaction
+	spent := make(map[string]bool)
+	fees, blockSize := 0, 0
+
+	for _, c := range candidates {
+		if blockSize+c.size > maxBlockSize {
+			continue
+		}
 
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+		// 跳过与已选交易花费同一输出的交易
+		conflict := false
+		for _, in := range c.tx.Inputs {
+			if spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			continue
+		}
+		for _, in := range c.tx.Inputs {
+			spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] = true
 		}
+
+		txs = append(txs, c.tx)
+		fees += c.fee
+		blockSize += c.size
 	}
 
 	if len(txs) == 0 {
 		fmt.Println("All Transactions are invalid")
-		return
+		return false
 	}
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
+	// coinbase 领取新区块高度对应的区块奖励和所有交易的手续费
+	subsidy := n.params.Subsidy(parentHeader.Height + 1)
+	cbTx, err := blockchain.CoinbaseTx(n.mineAddress, "", subsidy+fees)
+	if err != nil {
+		fmt.Printf("Mining failed: %v\n", err)
+		return false
+	}
 	txs = append(txs, cbTx)
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-	UTXOSet.Reindex()
+	// 节点停止时同样取消挖矿
+	ctx, cancel := context.WithCancel(n.ctx)
+	n.miningMutex.Lock()
+	n.cancelMining = cancel
+	n.miningMutex.Unlock()
+
+	newBlock, err := n.chain.MineBlockOn(ctx, parent, txs)
+
+	n.miningMutex.Lock()
+	n.cancelMining = nil
+	n.miningMutex.Unlock()
+	cancel()
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Mining aborted, chain tip changed")
+		return false
+	}
+	if err != nil {
+		fmt.Printf("Mining failed: %v\n", err)
+
+		// 区块违反共识规则时删除导致区块无效的交易，否则下次挖矿仍会优先选择它们
+		var ruleErr *blockchain.RuleError
+		if errors.As(err, &ruleErr) {
+			n.mu.Lock()
+			for _, tx := range n.rejectedTxs(txs, ruleErr) {
+				fmt.Printf("Evicted transaction %x from memory pool\n", tx.ID)
+				delete(n.memoryPool, hex.EncodeToString(tx.ID))
+			}
+			n.mu.Unlock()
+		}
+		return false
+	}
 
 	fmt.Println("New Block mined")
 
+	n.mu.Lock()
 	for _, tx := range txs {
 		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+		delete(n.memoryPool, txID)
 	}
+	n.mu.Unlock()
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, "block", [][]byte{newBlock.Hash})
-		}
+	for _, peer := range n.Peers() {
+		peer.SendInv("block", [][]byte{newBlock.Hash})
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
-	}
+	return true
 }
 
-// HandleVersion 处理版本信息请求
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
-	var payload Version
+// rejectedTxs 返回被拒绝的区块中导致区块无效的交易
+// 重新验证区块中的每笔交易，都能通过验证时查找 RuleError 说明中指出的交易或输出
+// 区块因为与交易无关的规则（例如时间戳）被拒绝时返回 nil
+func (n *Node) rejectedTxs(txs []*blockchain.Transaction, ruleErr *blockchain.RuleError) []*blockchain.Transaction {
+	var invalid, named, all []*blockchain.Transaction
+	UTXOSet := blockchain.UTXOSet{Blockchain: n.chain}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
-	}
+	for _, tx := range txs {
+		if tx.IsCoinbase() {
+			continue
+		}
+		all = append(all, tx)
 
-	bestHeight := chain.GetBestHeight()
-	otherHeight := payload.BestHeight
+		if fee, err := UTXOSet.TransactionFee(tx); err != nil || fee < 0 {
+			invalid = append(invalid, tx)
+			continue
+		}
+		if err := n.chain.VerifyTransaction(tx); err != nil {
+			invalid = append(invalid, tx)
+			continue
+		}
 
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
-	} else if bestHeight > otherHeight {
-		SendVersion(payload.AddrFrom, chain)
+		// 双花和缺少输入的说明是输出，其它规则的说明以交易ID开头
+		if errors.Is(ruleErr, blockchain.ErrDoubleSpend) || errors.Is(ruleErr, blockchain.ErrMissingInput) {
+			for _, in := range tx.Inputs {
+				if ruleErr.Detail == fmt.Sprintf("%x:%d", in.ID, in.Out) {
+					named = append(named, tx)
+					break
+				}
+			}
+		} else if strings.HasPrefix(ruleErr.Detail, hex.EncodeToString(tx.ID)) {
+			named = append(named, tx)
+		}
 	}
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	if len(invalid) > 0 {
+		return invalid
+	}
+	if len(named) > 0 {
+		return named
 	}
+
+	// coinbase 金额超出限制说明交易手续费的计算有误，无法确定是哪一笔交易
+	if errors.Is(ruleErr, blockchain.ErrBadCoinbaseValue) {
+		return all
+	}
+	return nil
 }
 
-// HandleConnection 处理节点之间的连接
-func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
-	// 从连接中读取所有数据
-	req, err := ioutil.ReadAll(conn)
-	defer conn.Close() // 确保连接关闭
+// StopMining 取消当前正在进行的挖矿
+func (n *Node) StopMining() {
+	n.miningMutex.Lock()
+	defer n.miningMutex.Unlock()
 
-	if err != nil {
-		log.Panic(err) // 如果发生错误，输出日志并终止程序
+	if n.cancelMining != nil {
+		n.cancelMining()
 	}
+}
 
-	// 提取请求中的命令
-	command := BytesToCmd(req[:commandLength])
-	fmt.Printf("Received %s command\n", command)
-
-	// 根据命令调用对应的处理函数
-	switch command {
+// HandleMessage 根据命令调用对应的处理函数，载荷无法解码时返回错误
+func (n *Node) HandleMessage(p *Peer, msg *Message) error {
+	switch msg.Command {
 	case "addr": // 处理地址信息
-		HandleAddr(req)
+		return n.HandleAddr(p, msg.Payload)
+	case "getaddr": // 处理获取地址请求
+		return n.HandleGetAddr(p)
 	case "block": // 处理区块信息
-		HandleBlock(req, chain)
+		return n.HandleBlock(p, msg.Payload)
 	case "inv": // 处理库存信息
-		HandleInv(req, chain)
+		return n.HandleInv(p, msg.Payload)
 	case "getblocks": // 处理获取区块请求
-		HandleGetBlocks(req, chain)
+		return n.HandleGetBlocks(p)
 	case "getdata": // 处理获取数据请求
-		HandleGetData(req, chain)
+		return n.HandleGetData(p, msg.Payload)
 	case "tx": // 处理交易信息
-		HandleTx(req, chain)
-	case "version": // 处理版本信息
-		HandleVersion(req, chain)
+		return n.HandleTx(p, msg.Payload)
+	case "getproof": // 处理获取交易包含证明的请求
+		return n.HandleGetProof(p, msg.Payload)
+	case "proof": // 处理交易包含证明
+		return n.HandleProof(p, msg.Payload)
+	case "version", "verack": // 每个连接只握手一次
+		return fmt.Errorf("%w: unexpected %s after handshake", ErrHandshake, msg.Command)
 	default:
 		fmt.Println("Unknown command") // 未知命令
+		return nil
 	}
 }
 
 // StartServer 启动区块链节点服务器
-func StartServer(nodeID, minerAddress string) {
-	// 设置节点地址和矿工地址
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	mineAddress = minerAddress
-
-	// 监听指定协议和地址
-	ln, err := net.Listen(protocol, nodeAddress)
+// 节点在 port 端口上监听，使用数据目录 dataDir 中属于 params 网络的区块链，
+// seeds 中的节点和地址簿中的节点一起作为连接对象，收到退出信号后停止节点并关闭数据库
+func StartServer(dataDir string, params *blockchain.ChainParams, port, minerAddress string, seeds []string) {
+	// 加载或创建区块链
+	chain, err := blockchain.ContinueBlockChain(dataDir, params)
 	if err != nil {
-		log.Panic(err) // 如果监听失败，输出日志并终止程序
+		fmt.Println(err)
+		return
 	}
-	defer ln.Close() // 确保监听关闭
-
-	// 加载或创建区块链
-	chain := blockchain.ContinueBlockChain(nodeID)
 	defer chain.Database.Close() // 确保区块链数据库关闭
 
-	go CloseDB(chain) // 设置程序关闭时的清理函数
-
-	// 如果当前节点不是主节点，发送版本信息到主节点
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+	// 加载数据目录中的地址簿，节点停止时保存
+	book, err := LoadAddrBook(dataDir)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
 
-	// 无限循环，处理传入的连接
-	for {
-		conn, err := ln.Accept() // 接受传入的连接
-		if err != nil {
-			log.Panic(err)
-		}
-		go HandleConnection(conn, chain) // 使用 goroutine 异步处理连接
+	node := NewNode(chain, WithAddress(fmt.Sprintf("localhost:%s", port)), WithMiner(minerAddress), WithAddrBook(book), WithSeeds(seeds...))
+	if err := node.Start(context.Background()); err != nil {
+		log.Panic(err) // 如果监听失败，输出日志并终止程序
 	}
+
+	// 等待退出信号
+	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	d.WaitForDeathWithFunc(node.Stop)
 }
 
 // GobEncode 将数据编码为 Gob 格式
@@ -515,25 +823,7 @@ func GobEncode(data interface{}) []byte {
 	return buff.Bytes() // 返回编码后的字节数组
 }
 
-// NodeIsKnown 检查节点是否已经在已知节点列表中
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true // 如果地址在列表中，返回 true
-		}
-	}
-	return false // 否则返回 false
-}
-
-// CloseDB 设置程序退出时关闭区块链数据库
-func CloseDB(chain *blockchain.BlockChain) {
-	// 创建 Death 对象，用于捕获退出信号
-	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-
-	// 等待退出信号并执行清理操作
-	d.WaitForDeathWithFunc(func() {
-		defer os.Exit(1) // 确保程序退出
-		defer runtime.Goexit() // 确保所有 Goroutine 退出
-		chain.Database.Close() // 关闭数据库
-	})
+// decodePayload 解码消息载荷中 gob 编码的数据，载荷无效时返回错误
+func decodePayload(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
 }
@@ -0,0 +1,455 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xuanle1016/golang-blockchain/blockchain"
+)
+
+const (
+	defaultMaxOutbound = 8                // 默认主动连接的节点数量
+	defaultMaxInbound  = 32               // 默认最多接受的连接数量
+	connectInterval    = 5 * time.Second  // 检查连接数量并补充连接的间隔
+	addrRelayMax       = 10               // 地址数量不超过该值的 addr 消息中的新地址才会被转发
+	addrRelayPeers     = 2                // 每个新地址转发给多少个节点
+	maxClockSkew       = 10 * time.Minute // addr 消息中的时间戳最多可以比本地时间晚多少
+)
+
+// ErrNodeStopped 表示节点已经停止
+var ErrNodeStopped = errors.New("node is stopped")
+
+// Node 表示区块链网络中的一个节点
+// 节点的状态只通过方法访问，所有方法都可以被多个协程同时调用；
+// 同一个进程中可以运行多个使用不同区块链和地址的节点
+type Node struct {
+	chain       *blockchain.BlockChain
+	params      *blockchain.ChainParams
+	address     string   // 节点监听并告知其它节点的地址
+	seeds       []string // 启动时加入地址簿的初始节点
+	mineAddress string   // 挖矿奖励地址，为空时不挖矿
+	maxOutbound int      // 主动连接的节点数量目标
+	maxInbound  int      // 最多接受的连接数量
+	addrBook    *AddrBook
+
+	mu         sync.Mutex                        // 保护以下字段
+	memoryPool map[string]blockchain.Transaction // 存储未确认的交易
+	peers      map[*Peer]bool                    // 已经完成握手的节点
+	pending    map[string]bool                   // 正在连接或握手的地址
+	inbound    int                               // 对方发起的连接数量，包括正在握手的连接
+
+	miningMutex  sync.Mutex         // 保护 mining 和 cancelMining
+	mining       bool               // 是否正在挖矿
+	cancelMining context.CancelFunc // 取消当前正在进行的挖矿
+
+	ctx      context.Context    // 节点停止时被取消
+	cancel   context.CancelFunc // 停止节点
+	listener net.Listener
+	wg       sync.WaitGroup // 等待节点的所有协程退出
+}
+
+// Option 配置 NewNode 创建的节点
+type Option func(*Node)
+
+// WithAddress 设置节点监听的地址，默认为本机上网络的默认端口
+func WithAddress(addr string) Option {
+	return func(n *Node) {
+		n.address = addr
+	}
+}
+
+// WithMiner 启用挖矿，挖矿奖励支付到 address
+func WithMiner(address string) Option {
+	return func(n *Node) {
+		n.mineAddress = address
+	}
+}
+
+// WithSeeds 设置初始节点，节点启动时将它们加入地址簿并优先尝试连接
+// 地址簿中已经有其它节点时，初始节点不可用也不影响节点加入网络
+func WithSeeds(addrs ...string) Option {
+	return func(n *Node) {
+		n.seeds = append(n.seeds, addrs...)
+	}
+}
+
+// WithAddrBook 设置节点使用的地址簿，默认使用只保存在内存中的空地址簿
+func WithAddrBook(book *AddrBook) Option {
+	return func(n *Node) {
+		n.addrBook = book
+	}
+}
+
+// WithMaxOutbound 设置主动连接的节点数量目标，手动添加的节点总是会被连接
+func WithMaxOutbound(count int) Option {
+	return func(n *Node) {
+		n.maxOutbound = count
+	}
+}
+
+// WithMaxInbound 设置最多接受的连接数量
+func WithMaxInbound(count int) Option {
+	return func(n *Node) {
+		n.maxInbound = count
+	}
+}
+
+// NewNode 创建一个使用区块链 chain 的节点
+// 节点不负责关闭区块链，调用 Stop 之后由调用者关闭
+func NewNode(chain *blockchain.BlockChain, opts ...Option) *Node {
+	n := &Node{
+		chain:       chain,
+		params:      chain.Params,
+		address:     fmt.Sprintf("localhost:%s", chain.Params.DefaultPort),
+		maxOutbound: defaultMaxOutbound,
+		maxInbound:  defaultMaxInbound,
+		addrBook:    NewAddrBook(""),
+		memoryPool:  make(map[string]blockchain.Transaction),
+		peers:       make(map[*Peer]bool),
+		pending:     make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	return n
+}
+
+// Addr 返回节点监听的地址
+func (n *Node) Addr() string {
+	return n.address
+}
+
+// AddrBook 返回节点使用的地址簿
+func (n *Node) AddrBook() *AddrBook {
+	return n.addrBook
+}
+
+// Start 开始监听连接，并在后台按照地址簿维持与其它节点的连接
+// ctx 被取消时节点停止，与调用 Stop 的效果相同
+func (n *Node) Start(ctx context.Context) error {
+	ln, err := net.Listen(protocol, n.address)
+	if err != nil {
+		return err
+	}
+
+	n.listener = ln
+	n.ctx, n.cancel = context.WithCancel(ctx)
+
+	// 初始节点作为最近看到的地址加入地址簿，格式无效的地址被忽略
+	for _, addr := range n.seeds {
+		if addr != n.address {
+			n.addrBook.Add(addr, time.Now())
+		}
+	}
+
+	n.wg.Add(3)
+	go n.acceptLoop()
+	go n.connectionManager()
+	go func() {
+		defer n.wg.Done()
+		<-n.ctx.Done()
+		n.shutdown()
+	}()
+
+	return nil
+}
+
+// Stop 停止节点：关闭监听、断开所有连接并取消挖矿，等待节点的协程全部退出
+func (n *Node) Stop() {
+	if n.cancel == nil {
+		return
+	}
+	n.cancel()
+	n.wg.Wait()
+}
+
+// shutdown 在节点停止时释放网络资源
+func (n *Node) shutdown() {
+	n.listener.Close()
+	n.StopMining()
+
+	for _, p := range n.Peers() {
+		p.Disconnect()
+	}
+}
+
+// connectionManager 定期检查主动连接的数量，从地址簿中选择节点补足连接，并保存地址簿
+func (n *Node) connectionManager() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+
+	for {
+		n.connectPeers()
+		if err := n.addrBook.SaveIfChanged(); err != nil {
+			fmt.Printf("Failed to save address book: %v\n", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-n.ctx.Done():
+			if err := n.addrBook.Save(); err != nil {
+				fmt.Printf("Failed to save address book: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// connectPeers 连接所有手动添加的节点，并从其它地址中补足 maxOutbound 个主动连接
+func (n *Node) connectPeers() {
+	need := n.maxOutbound - n.outboundCount()
+
+	for _, ka := range n.addrBook.Candidates() {
+		if n.ctx.Err() != nil {
+			return
+		}
+		if !ka.Manual && need <= 0 {
+			break
+		}
+		if ka.Addr == n.address || n.isConnected(ka.Addr) {
+			continue
+		}
+
+		if err := n.ConnectNode(ka.Addr); err != nil {
+			fmt.Printf("%s is not available: %v\n", ka.Addr, err)
+			continue
+		}
+		if !ka.Manual {
+			need--
+		}
+	}
+}
+
+// acceptLoop 接受其它节点发起的连接，直到监听被关闭
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if n.ctx.Err() == nil {
+				fmt.Printf("Accept failed: %v\n", err)
+			}
+			return
+		}
+
+		// 在握手之前检查连接数量，达到上限时直接关闭连接，不为其启动协程
+		if !n.acceptInbound() {
+			fmt.Printf("Too many inbound connections, rejecting %s\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		n.wg.Add(1)
+		go n.runPeer(newPeer(conn, n.params.Magic, true), "") // 使用 goroutine 异步处理连接
+	}
+}
+
+// acceptInbound 在对方发起的连接数量未达到 maxInbound 时为新连接计数并返回 true
+// 计数在 runPeer 结束时减少
+func (n *Node) acceptInbound() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.inbound >= n.maxInbound {
+		return false
+	}
+	n.inbound++
+	return true
+}
+
+// ConnectNode 连接监听在 addr 上的节点，已经连接或正在连接时直接返回
+// 连接建立后在新的协程中完成握手并处理该节点的消息，连接结果记录在地址簿中
+func (n *Node) ConnectNode(addr string) error {
+	if n.ctx == nil || n.ctx.Err() != nil {
+		return ErrNodeStopped
+	}
+
+	n.mu.Lock()
+	if n.pending[addr] || n.connectedLocked(addr) {
+		n.mu.Unlock()
+		return nil
+	}
+	n.pending[addr] = true
+	n.mu.Unlock()
+
+	n.addrBook.Attempt(addr)
+
+	var dialer net.Dialer
+	ctx, cancel := context.WithTimeout(n.ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, protocol, addr)
+	if err != nil {
+		n.addrBook.Failed(addr)
+		n.clearPending(addr)
+		return err
+	}
+
+	n.wg.Add(1)
+	go n.runPeer(newPeer(conn, n.params.Magic, false), addr)
+	return nil
+}
+
+// clearPending 连接成功或失败后清除正在连接的标记
+func (n *Node) clearPending(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.pending, addr)
+}
+
+// runPeer 与节点完成握手，然后处理该节点发送的消息直到连接断开
+// dialAddr 是主动连接时拨号的地址，对方发起的连接为空
+func (n *Node) runPeer(p *Peer, dialAddr string) {
+	defer n.wg.Done()
+	defer p.Disconnect()
+	if p.inbound {
+		defer func() {
+			n.mu.Lock()
+			n.inbound--
+			n.mu.Unlock()
+		}()
+	}
+
+	err := n.startPeer(p)
+	if dialAddr != "" {
+		if err != nil {
+			n.addrBook.Failed(dialAddr)
+		} else {
+			n.addrBook.Good(dialAddr)
+		}
+		n.clearPending(dialAddr)
+	}
+	if err != nil {
+		fmt.Printf("Handshake with %s failed: %v\n", p, err)
+		return
+	}
+	defer n.removePeer(p)
+
+	fmt.Printf("Connected to %s, version %d, height %d\n", p, p.Version, p.BestHeight)
+
+	go p.writeLoop()
+
+	// 区块链较短的一方向对方请求区块
+	if local, err := n.chain.GetBestHeight(); err == nil && p.BestHeight > local {
+		p.SendGetBlocks()
+	}
+
+	if p.Version >= addrTimeVersion {
+		// 告知对方本节点的地址，主动连接时还向对方请求更多的地址
+		p.SendAddr([]NetAddress{{n.address, time.Now().Unix()}})
+		if dialAddr != "" {
+			p.SendGetAddr()
+		}
+	}
+	if dialAddr == "" && p.Addr != "" {
+		n.addrBook.Add(p.Addr, time.Now())
+	}
+
+	p.readLoop(n.HandleMessage)
+
+	// 断开时更新最近看到该节点的时间
+	if p.Addr != "" {
+		n.addrBook.Add(p.Addr, time.Now())
+	}
+}
+
+// startPeer 与节点完成握手并记录该节点
+func (n *Node) startPeer(p *Peer) error {
+	local, err := n.localVersion()
+	if err != nil {
+		return err
+	}
+	if err := p.handshake(local); err != nil {
+		return err
+	}
+
+	return n.addPeer(p)
+}
+
+// localVersion 返回本节点在握手时发送的 Version 消息
+func (n *Node) localVersion() (*Version, error) {
+	bestHeight, err := n.chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Version{version, SFNodeNetwork, bestHeight, n.address, n.params.Genesis.Hash}, nil
+}
+
+// Peers 返回所有已经完成握手的节点
+func (n *Node) Peers() []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	list := make([]*Peer, 0, len(n.peers))
+	for p := range n.peers {
+		list = append(list, p)
+	}
+
+	return list
+}
+
+// isConnected 检查是否已经与监听在 addr 上的节点建立连接或正在连接
+func (n *Node) isConnected(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.pending[addr] || n.connectedLocked(addr)
+}
+
+// connectedLocked 检查是否已经与监听在 addr 上的节点完成握手，调用者需要持有锁
+func (n *Node) connectedLocked(addr string) bool {
+	for p := range n.peers {
+		if p.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundCount 返回主动连接（包括正在连接）的节点数量
+func (n *Node) outboundCount() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	count := len(n.pending)
+	for p := range n.peers {
+		if !p.inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// addPeer 记录完成握手的节点，双方同时发起连接等原因导致重复连接时返回错误
+func (n *Node) addPeer(p *Peer) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ctx.Err() != nil {
+		return ErrNodeStopped
+	}
+	if p.Addr != "" && n.connectedLocked(p.Addr) {
+		return fmt.Errorf("already connected to %s", p.Addr)
+	}
+	n.peers[p] = true
+
+	return nil
+}
+
+// removePeer 删除已经断开的节点
+func (n *Node) removePeer(p *Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.peers, p)
+}
@@ -0,0 +1,258 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xuanle1016/golang-blockchain/blockchain"
+)
+
+const (
+	minProtocolVersion = 2                // 支持的最低协议版本，之前的版本每条消息使用一个连接
+	addrTimeVersion    = 3                // 从该版本开始 addr 消息带有时间戳
+	dialTimeout        = 10 * time.Second // 连接其它节点的超时时间
+	handshakeTimeout   = 30 * time.Second // 连接建立后必须在该时间内完成握手
+	writeTimeout       = time.Minute      // 发送一条消息的超时时间
+	proofTimeout       = 10 * time.Second // 命令行客户端等待交易包含证明的时间，全节点找不到交易时不会回复
+	sendQueueSize      = 64               // 每个节点待发送消息队列的长度
+)
+
+// 节点提供的服务，在握手时通过 Version.Services 告知对方
+const (
+	SFNodeNetwork uint64 = 1 << iota // 保存完整的区块链，可以提供区块和交易包含证明
+)
+
+// ErrHandshake 表示握手失败，对方不是兼容的节点
+var ErrHandshake = errors.New("handshake failed")
+
+// Peer 表示与另一个节点之间完成握手的长连接
+// 握手之后双方的所有消息都通过这个连接传输，由一个读协程依次处理收到的消息，
+// 一个写协程按顺序发送队列中的消息
+type Peer struct {
+	conn    net.Conn
+	magic   [4]byte
+	inbound bool // 是否由对方发起连接
+
+	// 以下字段来自对方在握手时发送的 Version 消息
+	Addr       string // 对方监听的地址，对方不接受连接（如命令行客户端）时为空
+	Version    int    // 对方的协议版本
+	Services   uint64 // 对方提供的服务
+	BestHeight int    // 握手时对方区块链的高度
+
+	// blocksInTransit 是对方通过 inv 告知、等待依次向对方请求的区块
+	// 只由该节点的读协程在处理消息时访问，不需要加锁
+	blocksInTransit [][]byte
+
+	send      chan *Message
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPeer 为一个已经建立的 TCP 连接创建节点，inbound 表示连接是否由对方发起
+func newPeer(conn net.Conn, magic [4]byte, inbound bool) *Peer {
+	return &Peer{
+		conn:    conn,
+		magic:   magic,
+		inbound: inbound,
+		send:    make(chan *Message, sendQueueSize),
+		quit:    make(chan struct{}),
+	}
+}
+
+// String 返回用于日志的节点名称
+func (p *Peer) String() string {
+	if p.Addr != "" {
+		return p.Addr
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// handshake 与对方交换 Version 消息并互相确认（version → verack）
+// 主动发起连接的一方先发送 Version，另一方收到后回复自己的 Version 和 verack，
+// 双方都收到对方的 Version 和 verack 之后握手完成
+// 握手期间只有当前协程读写连接，所以直接写入而不经过发送队列
+func (p *Peer) handshake(local *Version) error {
+	p.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer p.conn.SetDeadline(time.Time{})
+
+	if !p.inbound {
+		if err := writeMessage(p.conn, p.magic, "version", GobEncode(*local)); err != nil {
+			return err
+		}
+	}
+
+	gotVersion, gotVerAck := false, false
+	for !gotVersion || !gotVerAck {
+		msg, err := readMessage(p.conn, p.magic)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Command {
+		case "version":
+			if gotVersion {
+				return fmt.Errorf("%w: duplicate version message", ErrHandshake)
+			}
+			var remote Version
+			if err := decodePayload(msg.Payload, &remote); err != nil {
+				return err
+			}
+			if err := p.checkVersion(local, &remote); err != nil {
+				return err
+			}
+			gotVersion = true
+
+			if p.inbound {
+				if err := writeMessage(p.conn, p.magic, "version", GobEncode(*local)); err != nil {
+					return err
+				}
+			}
+			if err := writeMessage(p.conn, p.magic, "verack", nil); err != nil {
+				return err
+			}
+		case "verack":
+			gotVerAck = true
+		default:
+			return fmt.Errorf("%w: received %s before version and verack", ErrHandshake, msg.Command)
+		}
+	}
+
+	return nil
+}
+
+// checkVersion 检查对方的 Version 消息，并记录对方的信息
+func (p *Peer) checkVersion(local, remote *Version) error {
+	if remote.Version < minProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d is too old", ErrHandshake, remote.Version)
+	}
+	// 创世区块不同的节点不属于同一个网络，不与其同步也不记录其地址
+	if !bytes.Equal(remote.GenesisHash, local.GenesisHash) {
+		return fmt.Errorf("%w: genesis block %x does not match %x", ErrHandshake, remote.GenesisHash, local.GenesisHash)
+	}
+	if remote.AddrFrom != "" && remote.AddrFrom == local.AddrFrom {
+		return fmt.Errorf("%w: connected to self", ErrHandshake)
+	}
+
+	p.Addr = remote.AddrFrom
+	p.Version = remote.Version
+	p.Services = remote.Services
+	p.BestHeight = remote.BestHeight
+
+	return nil
+}
+
+// QueueMessage 将消息放入发送队列，由写协程发送，调用者不会被阻塞
+// 队列已满说明对方长时间没有读取数据，此时断开连接，避免一个停滞的节点拖住转发消息的协程；
+// 节点断开后丢弃消息
+func (p *Peer) QueueMessage(command string, payload []byte) {
+	select {
+	case <-p.quit:
+		return
+	default:
+	}
+
+	select {
+	case p.send <- &Message{command, payload}:
+	default:
+		fmt.Printf("Send queue of %s is full, disconnecting\n", p)
+		p.Disconnect()
+	}
+}
+
+// writeLoop 依次发送队列中的消息，发送失败时断开连接
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := writeMessage(p.conn, p.magic, msg.Command, msg.Payload); err != nil {
+				fmt.Printf("Failed to send %s to %s: %v\n", msg.Command, p, err)
+				p.Disconnect()
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// readLoop 依次读取并处理对方发送的消息，直到连接断开或收到无效消息
+func (p *Peer) readLoop(handle func(*Peer, *Message) error) {
+	for {
+		msg, err := readMessage(p.conn, p.magic)
+		if err != nil {
+			select {
+			case <-p.quit:
+				// 连接已经由本节点关闭
+			default:
+				fmt.Printf("Disconnected from %s: %v\n", p, err)
+			}
+			return
+		}
+
+		fmt.Printf("Received %s command from %s\n", msg.Command, p)
+
+		if err := handle(p, msg); err != nil {
+			// 消息无效时断开连接
+			fmt.Printf("Invalid %s message from %s: %v\n", msg.Command, p, err)
+			return
+		}
+	}
+}
+
+// Disconnect 关闭与对方的连接，可以重复调用
+func (p *Peer) Disconnect() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// SendAddr 发送已知节点的地址列表
+func (p *Peer) SendAddr(addrs []NetAddress) {
+	p.QueueMessage("addr", GobEncode(Addr{addrs}))
+}
+
+// SendGetAddr 请求对方地址簿中的地址，消息没有载荷
+func (p *Peer) SendGetAddr() {
+	p.QueueMessage("getaddr", nil)
+}
+
+// SendBlock 发送区块数据
+func (p *Peer) SendBlock(b *blockchain.Block) {
+	p.QueueMessage("block", GobEncode(Block{b.Serialize()}))
+}
+
+// SendInv 发送库存（区块或交易）数据
+func (p *Peer) SendInv(kind string, items [][]byte) {
+	p.QueueMessage("inv", GobEncode(Inv{kind, items}))
+}
+
+// SendGetBlocks 请求对方主链上所有区块的哈希，消息没有载荷
+func (p *Peer) SendGetBlocks() {
+	p.QueueMessage("getblocks", nil)
+}
+
+// SendGetData 发送获取数据请求（区块或交易）
+func (p *Peer) SendGetData(kind string, id []byte) {
+	p.QueueMessage("getdata", GobEncode(GetData{kind, id}))
+}
+
+// SendGetProof 向全节点请求交易的包含证明
+func (p *Peer) SendGetProof(txID []byte) {
+	p.QueueMessage("getproof", GobEncode(GetProof{txID}))
+}
+
+// SendProof 发送交易包含证明
+func (p *Peer) SendProof(proof *blockchain.TxProof) {
+	p.QueueMessage("proof", GobEncode(Proof{proof.Serialize()}))
+}
+
+// SendTx 发送交易数据
+func (p *Peer) SendTx(tnx *blockchain.Transaction) {
+	p.QueueMessage("tx", GobEncode(Tx{tnx.Serialize()}))
+}
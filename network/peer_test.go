@@ -0,0 +1,223 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+var testGenesis = []byte("genesis")
+
+// testVersion 返回地址为 addr、创世区块为 genesis 的节点发送的 Version 消息
+func testVersion(addr string, genesis []byte) *Version {
+	return &Version{version, SFNodeNetwork, 7, addr, genesis}
+}
+
+// handshakePeers 让连接两端的节点同时握手，返回双方的结果
+// 任意一方失败时关闭连接，使另一方不再等待
+func handshakePeers(out, in *Peer, outVersion, inVersion *Version) (error, error) {
+	outErr := make(chan error, 1)
+	go func() {
+		err := out.handshake(outVersion)
+		if err != nil {
+			out.Disconnect()
+		}
+		outErr <- err
+	}()
+
+	inErr := in.handshake(inVersion)
+	if inErr != nil {
+		in.Disconnect()
+	}
+	return <-outErr, inErr
+}
+
+func TestHandshake(t *testing.T) {
+	local, remote := testVersion("b:2", testGenesis), testVersion("a:1", testGenesis)
+
+	// readVersion 读取本节点发送的 Version 并检查内容
+	readVersion := func(conn net.Conn) error {
+		msg, err := readMessage(conn, testMagic)
+		if err != nil {
+			return err
+		}
+		var v Version
+		if err := decodePayload(msg.Payload, &v); err != nil {
+			return err
+		}
+		if msg.Command != "version" || v.AddrFrom != local.AddrFrom {
+			return fmt.Errorf("received %s from %q, want version from %q", msg.Command, v.AddrFrom, local.AddrFrom)
+		}
+		return nil
+	}
+	readVerAck := func(conn net.Conn) error {
+		msg, err := readMessage(conn, testMagic)
+		if err == nil && msg.Command != "verack" {
+			err = fmt.Errorf("received %s, want verack", msg.Command)
+		}
+		return err
+	}
+	writeVersion := func(conn net.Conn) error {
+		return writeMessage(conn, testMagic, "version", GobEncode(*remote))
+	}
+	writeVerAck := func(conn net.Conn) error {
+		return writeMessage(conn, testMagic, "verack", nil)
+	}
+
+	// net.Pipe 没有缓冲，对方的每一步都必须与本节点的读写顺序对应
+	tests := []struct {
+		name    string
+		inbound bool
+		steps   []func(conn net.Conn) error
+	}{
+		{"inbound", true, []func(net.Conn) error{writeVersion, readVersion, readVerAck, writeVerAck}},
+		{"outbound", false, []func(net.Conn) error{readVersion, writeVersion, readVerAck, writeVerAck}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			p := newPeer(c2, testMagic, tt.inbound)
+			defer p.Disconnect()
+			defer c1.Close()
+
+			remoteErr := make(chan error, 1)
+			go func() {
+				for _, step := range tt.steps {
+					if err := step(c1); err != nil {
+						remoteErr <- err
+						return
+					}
+				}
+				remoteErr <- nil
+			}()
+
+			if err := p.handshake(local); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-remoteErr; err != nil {
+				t.Fatalf("remote: %v", err)
+			}
+
+			// 记录了对方 Version 消息中的信息
+			if p.Addr != remote.AddrFrom || p.Version != version || p.Services != SFNodeNetwork || p.BestHeight != remote.BestHeight {
+				t.Fatalf("peer %s: version %d, services %d, height %d", p, p.Version, p.Services, p.BestHeight)
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsPeer(t *testing.T) {
+	tests := []struct {
+		name     string
+		outbound *Version
+		inbound  *Version
+	}{
+		{"genesis mismatch", testVersion("a:1", []byte("other")), testVersion("b:2", testGenesis)},
+		{"old version", &Version{minProtocolVersion - 1, 0, 0, "a:1", testGenesis}, testVersion("b:2", testGenesis)},
+		{"self connection", testVersion("a:1", testGenesis), testVersion("a:1", testGenesis)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			out, in := newPeer(c1, testMagic, false), newPeer(c2, testMagic, true)
+			defer out.Disconnect()
+			defer in.Disconnect()
+
+			// 接受连接的一方检查 Version 后拒绝对方，发起连接的一方因为连接关闭而失败
+			outErr, inErr := handshakePeers(out, in, tt.outbound, tt.inbound)
+			if !errors.Is(inErr, ErrHandshake) {
+				t.Fatalf("inbound handshake = %v, want %v", inErr, ErrHandshake)
+			}
+			if outErr == nil {
+				t.Fatal("outbound handshake succeeded")
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsEarlyMessage(t *testing.T) {
+	local := testVersion("b:2", testGenesis)
+
+	// sendVersion 发送对方的 Version，并读取本节点回复的 version 和 verack
+	sendVersion := func(conn net.Conn) error {
+		if err := writeMessage(conn, testMagic, "version", GobEncode(*testVersion("a:1", testGenesis))); err != nil {
+			return err
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := readMessage(conn, testMagic); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		remote func(conn net.Conn) error // 对方在连接上的行为
+	}{
+		{"before version", func(conn net.Conn) error {
+			return writeMessage(conn, testMagic, "inv", GobEncode(Inv{"block", nil}))
+		}},
+		{"before verack", func(conn net.Conn) error {
+			if err := sendVersion(conn); err != nil {
+				return err
+			}
+			return writeMessage(conn, testMagic, "getblocks", nil)
+		}},
+		{"duplicate version", func(conn net.Conn) error {
+			if err := sendVersion(conn); err != nil {
+				return err
+			}
+			return writeMessage(conn, testMagic, "version", GobEncode(*testVersion("a:1", testGenesis)))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			p := newPeer(c2, testMagic, true)
+			defer p.Disconnect()
+			defer c1.Close()
+
+			remoteErr := make(chan error, 1)
+			go func() { remoteErr <- tt.remote(c1) }()
+
+			if err := p.handshake(local); !errors.Is(err, ErrHandshake) {
+				t.Fatalf("handshake = %v, want %v", err, ErrHandshake)
+			}
+			if err := <-remoteErr; err != nil {
+				t.Fatalf("remote: %v", err)
+			}
+		})
+	}
+}
+
+func TestQueueMessageFullQueue(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	p := newPeer(c2, testMagic, false)
+	defer p.Disconnect()
+
+	// 没有写协程发送消息，队列填满后下一条消息使节点断开而不是阻塞
+	for i := 0; i < sendQueueSize; i++ {
+		p.QueueMessage("getaddr", nil)
+	}
+	select {
+	case <-p.quit:
+		t.Fatal("disconnected before the queue was full")
+	default:
+	}
+
+	p.QueueMessage("getaddr", nil)
+	select {
+	case <-p.quit:
+	default:
+		t.Fatal("peer with a full queue is still connected")
+	}
+
+	// 断开后的消息直接丢弃
+	p.QueueMessage("getaddr", nil)
+}
@@ -12,10 +12,7 @@ import (
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	checksumLength = 4 // 校验和的长度
-	version        = byte(0x00) // 地址的版本号
-)
+const checksumLength = 4 // 校验和的长度
 
 // Wallet 结构体表示一个钱包
 type Wallet struct {
@@ -49,8 +46,8 @@ func DeserializePublicKey(publicBytes []byte) *ecdsa.PublicKey {
 }
 
 // Address 生成钱包地址
-// 地址包含公钥的哈希值、版本号和校验和
-func (w Wallet) Address() []byte {
+// 地址包含公钥的哈希值、版本号和校验和，version 是钱包所属网络的地址版本号
+func (w Wallet) Address(version byte) []byte {
 	pubHash := PublicKeyHash(w.PublicKey) // 计算公钥的哈希
 
 	// 添加版本号
@@ -67,11 +64,16 @@ func (w Wallet) Address() []byte {
 }
 
 // ValidateAddress 验证地址是否有效
-// 输入为地址字符串，返回布尔值
-func ValidateAddress(address string) bool {
+// 输入为地址字符串和所属网络的地址版本号，其它网络的地址视为无效
+func ValidateAddress(address string, version byte) bool {
 	pubKeyHash := Base58Decode([]byte(address))        // 解码地址
+	if len(pubKeyHash) <= 1+checksumLength {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:] // 提取校验和
-	version := pubKeyHash[0]                           // 提取版本号
+	if pubKeyHash[0] != version {                                 // 检查版本号
+		return false
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]   // 提取公钥哈希部分
 	// 计算目标校验和
 	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
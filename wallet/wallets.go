@@ -4,33 +4,38 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 )
 
-const walletFile = "./tmp/wallets_%s.data" // 定义钱包文件的存储路径模板，%s 会替换为节点ID
+const walletFile = "wallets.data" // 钱包文件在数据目录中的文件名
 
 // Wallets 结构体用于存储多个钱包
 type Wallets struct {
 	Wallets map[string]*Wallet // 使用映射存储钱包，键为钱包地址，值为对应的 Wallet 对象
 }
 
-// CreateWallets 创建一个新的 Wallets 实例，并加载与 nodeId 相关的已有钱包文件
-func CreateWallets(nodeId string) (*Wallets, error) {
+// FilePath 返回数据目录 dataDir 中钱包文件的路径
+func FilePath(dataDir string) string {
+	return filepath.Join(dataDir, walletFile)
+}
+
+// CreateWallets 创建一个新的 Wallets 实例，并加载数据目录 dataDir 中已有的钱包文件
+func CreateWallets(dataDir string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet) // 初始化钱包映射
 
-	// 加载与 nodeId 相关的钱包文件
-	err := wallets.LoadFile(nodeId)
+	// 加载数据目录中的钱包文件
+	err := wallets.LoadFile(dataDir)
 	return &wallets, err
 }
 
-// AddWallet 创建一个新的钱包并将其添加到 Wallets 中，返回钱包的地址
-func (ws *Wallets) AddWallet() string {
+// AddWallet 创建一个新的钱包并将其添加到 Wallets 中，返回使用地址版本号 version 生成的钱包地址
+func (ws *Wallets) AddWallet(version byte) string {
 	wallet := MakeWallet()       // 创建一个新的钱包
-	address := string(wallet.Address()) // 获取钱包地址并转换为字符串
+	address := string(wallet.Address(version)) // 获取钱包地址并转换为字符串
 
 	// 将钱包添加到映射中
 	ws.Wallets[address] = wallet
@@ -56,8 +61,8 @@ func (ws Wallets) GetWallet(address string) Wallet {
 }
 
 // LoadFile 从文件中加载钱包数据，如果文件不存在则返回错误
-func (ws *Wallets) LoadFile(nodeID string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeID) // 使用 nodeID 构造钱包文件路径
+func (ws *Wallets) LoadFile(dataDir string) error {
+	walletFile := FilePath(dataDir) // 钱包文件路径
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err // 如果文件不存在，返回错误
 	}
@@ -83,10 +88,10 @@ func (ws *Wallets) LoadFile(nodeID string) error {
 	return nil // 加载成功，返回 nil
 }
 
-// SaveFile 将当前 Wallets 的数据保存到文件
-func (ws *Wallets) SaveFile(nodeId string) {
+// SaveFile 将当前 Wallets 的数据保存到数据目录 dataDir 中的钱包文件，目录不存在时自动创建
+func (ws *Wallets) SaveFile(dataDir string) {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeId) // 使用 nodeId 构造钱包文件路径
+	walletFile := FilePath(dataDir) // 钱包文件路径
 
 	gob.Register(elliptic.P256()) // 注册椭圆曲线算法
 
@@ -97,6 +102,9 @@ func (ws *Wallets) SaveFile(nodeId string) {
 	}
 
 	// 将编码后的内容写入文件
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Panic(err)
+	}
 	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
 	if err != nil {
 		log.Panic(err) // 写入文件失败则 panic